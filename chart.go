@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+type ChartMetadata struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	AppVersion  string `json:"appVersion,omitempty"`
+	Description string `json:"description,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Type        string `json:"type,omitempty"`
+	//only checked, subcharts are not rendered
+	Dependencies []interface{} `json:"dependencies,omitempty"`
+}
+
+//files of the chart outside of templates, available to templates as .Files
+type ChartFiles map[string][]byte
+
+//fields of the template data that need a cluster or a chart loader
+var unsupportedChartData = regexp.MustCompile(`(^|[^\w.)\]])\$?\.Capabilities\b`)
+
+//files excluded from .Files, as in helm
+var chartSpecialFiles = map[string]bool{
+	"Chart.yaml": true, "Chart.lock": true, "values.yaml": true, "values.schema.json": true,
+	"requirements.yaml": true, "requirements.lock": true,
+}
+
+func (files ChartFiles) GetBytes(name string) []byte {
+	return files[name]
+}
+
+func (files ChartFiles) Get(name string) string {
+	return string(files[name])
+}
+
+func (files ChartFiles) Lines(name string) []string {
+	if len(files[name]) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(string(files[name]), "\n"), "\n")
+}
+
+func (files ChartFiles) Glob(pattern string) ChartFiles {
+	matches := make(ChartFiles)
+
+	for name, content := range files {
+		if matchGlob(pattern, name) {
+			matches[name] = content
+		}
+	}
+
+	return matches
+}
+
+type ChartRelease struct {
+	Name      string
+	Namespace string
+	Service   string
+	IsInstall bool
+	IsUpgrade bool
+	Revision  int
+}
+
+func readChartMetadata(dir string) (ChartMetadata, error) {
+	var metadata ChartMetadata
+	b, err := ioutil.ReadFile(filepath.Join(dir, "Chart.yaml"))
+
+	if err != nil {
+		return metadata, err
+	}
+
+	if err := yaml.Unmarshal(b, &metadata); err != nil {
+		return metadata, fmt.Errorf("%s: %s", filepath.Join(dir, "Chart.yaml"), err.Error())
+	}
+
+	if metadata.Name == "" {
+		return metadata, fmt.Errorf("%s: missing chart name", filepath.Join(dir, "Chart.yaml"))
+	}
+
+	return metadata, nil
+}
+
+//chart defaults from values.yaml are overridden by values files and then --set flags
+func loadChartValues(dir string, valuesFiles []string, sets []string) (map[string]interface{}, error) {
+	files := valuesFiles
+	defaults := filepath.Join(dir, "values.yaml")
+
+	if _, err := os.Stat(defaults); err == nil {
+		files = append([]string{defaults}, valuesFiles...)
+	}
+
+	return loadValues(nil, files, sets)
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+
+	return false
+}
+
+func toYAML(value interface{}) string {
+	b, err := yaml.Marshal(value)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSuffix(string(b), "\n")
+}
+
+func toJSON(value interface{}) string {
+	b, err := json.Marshal(value)
+
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func toInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		var i int
+		fmt.Sscan(v, &i)
+		return i
+	}
+
+	return 0
+}
+
+//the subset of sprig and helm functions commonly used by charts
+func getChartFuncs(t *template.Template) template.FuncMap {
+	includeDepth := 0
+
+	return template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			if includeDepth > 100 {
+				return "", fmt.Errorf("template %q included recursively", name)
+			}
+
+			includeDepth++
+			defer func() { includeDepth-- }()
+
+			var buf bytes.Buffer
+			err := t.ExecuteTemplate(&buf, name, data)
+			return buf.String(), err
+		},
+		"tpl": func(text string, data interface{}) (string, error) {
+			clone, err := t.Clone()
+
+			if err != nil {
+				return "", err
+			}
+
+			parsed, err := clone.New("tpl").Parse(text)
+
+			if err != nil {
+				return "", err
+			}
+
+			var buf bytes.Buffer
+			err = parsed.Execute(&buf, data)
+			return strings.Replace(buf.String(), "<no value>", "", -1), err
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if value == nil || value == "" {
+				return nil, errors.New(message)
+			}
+
+			return value, nil
+		},
+		"default": func(defaultValue interface{}, value ...interface{}) interface{} {
+			if len(value) == 0 || isEmptyValue(value[0]) {
+				return defaultValue
+			}
+
+			return value[0]
+		},
+		"empty": isEmptyValue,
+		"coalesce": func(values ...interface{}) interface{} {
+			for _, value := range values {
+				if !isEmptyValue(value) {
+					return value
+				}
+			}
+
+			return nil
+		},
+		"ternary": func(a interface{}, b interface{}, condition bool) interface{} {
+			if condition {
+				return a
+			}
+
+			return b
+		},
+		"quote": func(values ...interface{}) string {
+			quoted := make([]string, 0, len(values))
+
+			for _, value := range values {
+				if value != nil {
+					quoted = append(quoted, fmt.Sprintf("%q", formatValue(value)))
+				}
+			}
+
+			return strings.Join(quoted, " ")
+		},
+		"squote": func(value interface{}) string {
+			return "'" + formatValue(value) + "'"
+		},
+		"toString":   formatValue,
+		"int":        toInt,
+		"add":        func(a interface{}, b interface{}) int { return toInt(a) + toInt(b) },
+		"sub":        func(a interface{}, b interface{}) int { return toInt(a) - toInt(b) },
+		"indent":     indent,
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+		"trunc": func(length int, s string) string {
+			if len(s) > length {
+				return s[:length]
+			}
+
+			return s
+		},
+		"upper":     strings.ToUpper,
+		"lower":     strings.ToLower,
+		"title":     strings.Title,
+		"replace":   func(old string, new string, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":  func(substr string, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix": func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix": func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+		"join": func(sep string, values interface{}) string {
+			var parts []string
+			v := reflect.ValueOf(values)
+
+			if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+				for i := 0; i < v.Len(); i++ {
+					parts = append(parts, formatValue(v.Index(i).Interface()))
+				}
+			}
+
+			return strings.Join(parts, sep)
+		},
+		"list": func(values ...interface{}) []interface{} { return values },
+		"dict": func(pairs ...interface{}) map[string]interface{} {
+			dict := make(map[string]interface{})
+
+			for i := 0; i+1 < len(pairs); i += 2 {
+				dict[formatValue(pairs[i])] = pairs[i+1]
+			}
+
+			return dict
+		},
+		"hasKey": func(dict map[string]interface{}, key string) bool {
+			_, ok := dict[key]
+			return ok
+		},
+		"toYaml":    toYAML,
+		"toJson":    toJSON,
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"sha256sum": func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+		"b64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+	}
+}
+
+func listChartTemplates(dir string) ([]string, error) {
+	var paths []string
+
+	err := filepath.Walk(filepath.Join(dir, "templates"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+
+	sort.Strings(paths)
+	return paths, err
+}
+
+func readChartFiles(dir string) (ChartFiles, error) {
+	files := make(ChartFiles)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if rel == "templates" || rel == "charts" {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if chartSpecialFiles[rel] {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		files[rel] = b
+
+		return err
+	})
+
+	return files, err
+}
+
+//subcharts are not rendered, so charts with dependencies would produce an incomplete plan
+func checkChartDependencies(dir string, metadata ChartMetadata) error {
+	if len(metadata.Dependencies) > 0 {
+		return fmt.Errorf("%s: chart dependencies are not supported, render each chart with -chart", filepath.Join(dir, "Chart.yaml"))
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "requirements.yaml")); err == nil {
+		return fmt.Errorf("%s: chart dependencies are not supported, render each chart with -chart", filepath.Join(dir, "requirements.yaml"))
+	}
+
+	if subcharts, _ := ioutil.ReadDir(filepath.Join(dir, "charts")); len(subcharts) > 0 {
+		return fmt.Errorf("%s: subcharts are not supported, render each chart with -chart", filepath.Join(dir, "charts"))
+	}
+
+	return nil
+}
+
+//templates are named after the chart and their path, as in helm
+func getChartTemplateName(dir string, metadata ChartMetadata, path string) string {
+	rel, _ := filepath.Rel(dir, path)
+	return filepath.ToSlash(filepath.Join(metadata.Name, rel))
+}
+
+//renders every template not starting with an underscore, like helm template, without a cluster
+func renderChart(dir string, release ChartRelease, values map[string]interface{}) ([]ManifestFile, error) {
+	metadata, err := readChartMetadata(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkChartDependencies(dir, metadata); err != nil {
+		return nil, err
+	}
+
+	paths, err := listChartTemplates(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	chartFiles, err := readChartFiles(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := template.New(metadata.Name)
+	t.Funcs(getChartFuncs(t)).Option("missingkey=zero")
+
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if unsupportedChartData.Match(b) {
+			return nil, fmt.Errorf("%s: .Capabilities is not supported, charts are rendered without a cluster", path)
+		}
+
+		if _, err := t.New(getChartTemplateName(dir, metadata, path)).Parse(string(b)); err != nil {
+			return nil, err
+		}
+	}
+
+	chart := map[string]interface{}{
+		"Name":        metadata.Name,
+		"Version":     metadata.Version,
+		"AppVersion":  metadata.AppVersion,
+		"Description": metadata.Description,
+		"APIVersion":  metadata.APIVersion,
+		"Type":        metadata.Type,
+	}
+
+	files := make([]ManifestFile, 0, len(paths))
+
+	for _, path := range paths {
+		name := getChartTemplateName(dir, metadata, path)
+		base := filepath.Base(path)
+
+		if strings.HasPrefix(base, "_") || !manifestExtensions[filepath.Ext(base)] {
+			continue
+		}
+
+		data := map[string]interface{}{
+			"Values":   values,
+			"Release":  release,
+			"Chart":    chart,
+			"Files":    chartFiles,
+			"Template": map[string]interface{}{"Name": name, "BasePath": metadata.Name + "/templates"},
+		}
+
+		var buf bytes.Buffer
+
+		if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+			return nil, err
+		}
+
+		content := strings.Replace(buf.String(), "<no value>", "", -1)
+
+		if strings.TrimSpace(content) != "" {
+			files = append(files, ManifestFile{path: path, content: content})
+		}
+	}
+
+	return files, nil
+}
@@ -35,6 +35,36 @@ func deepCompareObject(src runtime.Object, dst runtime.Object) []string {
 	return fields
 }
 
+//changing these fields requires deleting and recreating the object,
+//pairs are matched by label so a renamed object is also replaced
+func hasImmutableFieldChanges(src runtime.Object, dst runtime.Object) bool {
+	if getObjectGroupVersionKind(src).String() != getObjectGroupVersionKind(dst).String() {
+		return true
+	}
+
+	srcMetadata, _ := getObjectMetadata(src)
+	dstMetadata, _ := getObjectMetadata(dst)
+
+	if srcMetadata.GetName() != dstMetadata.GetName() || srcMetadata.GetNamespace() != dstMetadata.GetNamespace() {
+		return true
+	}
+
+	switch srcType := src.(type) {
+	case *batchv1.Job:
+		dstJob := dst.(*batchv1.Job)
+
+		if srcType.Spec.Completions != nil {
+			if dstJob.Spec.Completions == nil || *srcType.Spec.Completions != *dstJob.Spec.Completions {
+				return true
+			}
+		}
+
+		return len(deepComparePodTemplateSpec(srcType.Spec.Template, dstJob.Spec.Template)) > 0
+	}
+
+	return false
+}
+
 func deepCompareCronJobSpec(src batchv1beta1.CronJobSpec, dst batchv1beta1.CronJobSpec) []string {
 	var fields []string
 
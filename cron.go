@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+//parsed form of the standard 5-field cron schedules accepted by the cronjob controller
+type CronSchedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+	every   time.Duration
+}
+
+type cronField struct {
+	name  string
+	min   uint
+	max   uint
+	names map[string]uint
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 6, names: map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronSchedule(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if every < time.Second {
+			return nil, fmt.Errorf("@every interval must be at least one second")
+		}
+
+		return &CronSchedule{every: every}, nil
+	}
+
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	} else if strings.HasPrefix(spec, "@") {
+		return nil, fmt.Errorf("unknown descriptor %s", spec)
+	}
+
+	parts := strings.Fields(spec)
+
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields, found %d", len(cronFields), len(parts))
+	}
+
+	bits := make([]uint64, len(cronFields))
+
+	for i, part := range parts {
+		var err error
+		bits[i], err = parseCronField(part, cronFields[i])
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: parts[2] == "*" || parts[2] == "?",
+		dowStar: parts[4] == "*" || parts[4] == "?",
+	}, nil
+}
+
+func parseCronValue(value string, field cronField) (uint, error) {
+	if n, ok := field.names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 0)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q", field.name, value)
+	}
+
+	//7 is accepted as Sunday like in most cron implementations
+	if field.name == "day of week" && n == 7 {
+		n = 0
+	}
+
+	if uint(n) < field.min || uint(n) > field.max {
+		return 0, fmt.Errorf("%s value %d out of range %d-%d", field.name, n, field.min, field.max)
+	}
+
+	return uint(n), nil
+}
+
+//parses comma-separated lists of *, ?, values, ranges and steps into a bitset
+func parseCronField(expr string, field cronField) (uint64, error) {
+	var bits uint64
+
+	for _, item := range strings.Split(expr, ",") {
+		rangeExpr, step := item, uint(1)
+
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.ParseUint(item[i+1:], 10, 0)
+
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid %s step in %q", field.name, item)
+			}
+
+			rangeExpr, step = item[:i], uint(n)
+		}
+
+		var start, end uint
+
+		if rangeExpr == "*" || rangeExpr == "?" {
+			start, end = field.min, field.max
+		} else if i := strings.Index(rangeExpr, "-"); i >= 0 {
+			var err error
+
+			if start, err = parseCronValue(rangeExpr[:i], field); err != nil {
+				return 0, err
+			}
+
+			if end, err = parseCronValue(rangeExpr[i+1:], field); err != nil {
+				return 0, err
+			}
+
+			if end < start {
+				return 0, fmt.Errorf("invalid %s range %q", field.name, rangeExpr)
+			}
+		} else {
+			var err error
+
+			if start, err = parseCronValue(rangeExpr, field); err != nil {
+				return 0, err
+			}
+
+			end = start
+
+			//a single value with a step, like 5/15, runs until the end of the range
+			if strings.Contains(item, "/") {
+				end = field.max
+			}
+		}
+
+		for n := start; n <= end; n += step {
+			bits |= 1 << n
+		}
+	}
+
+	return bits, nil
+}
+
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := schedule.dom&(1<<uint(t.Day())) > 0
+	dowMatch := schedule.dow&(1<<uint(t.Weekday())) > 0
+
+	//when both day fields are restricted, a day matching either of them matches
+	if schedule.domStar || schedule.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+//returns the first fire time after t, or a zero time if there is none in the next five years
+func (schedule *CronSchedule) next(t time.Time) time.Time {
+	if schedule.every > 0 {
+		return t.Add(schedule.every).Truncate(time.Second)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if schedule.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if schedule.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (schedule *CronSchedule) nextTimes(t time.Time, n int) []time.Time {
+	var times []time.Time
+
+	for i := 0; i < n; i++ {
+		t = schedule.next(t)
+
+		if t.IsZero() {
+			break
+		}
+
+		times = append(times, t)
+	}
+
+	return times
+}
+
+func formatScheduleTimes(spec string, from time.Time, n int) string {
+	schedule, err := parseCronSchedule(spec)
+
+	if err != nil {
+		return "invalid schedule: " + err.Error()
+	}
+
+	var times []string
+
+	for _, t := range schedule.nextTimes(from, n) {
+		times = append(times, t.Format("2006-01-02 15:04 MST"))
+	}
+
+	if len(times) == 0 {
+		return "never"
+	}
+
+	return strings.Join(times, ", ")
+}
+
+//prints the next fire times of the old and new schedule of a CronJob whose schedule changes
+func printSchedulePreview(step Step, config PlanConfig) {
+	if config.schedulePreview <= 0 || step.pair.src == nil {
+		return
+	}
+
+	src, ok := (*step.pair.src).(*batchv1beta1.CronJob)
+
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if step.pair.dst != nil {
+		if dst, ok := (*step.pair.dst).(*batchv1beta1.CronJob); ok {
+			if dst.Spec.Schedule == src.Spec.Schedule {
+				return
+			}
+
+			fmt.Fprintf(config.output(), "  current schedule %q: %s\n", dst.Spec.Schedule, formatScheduleTimes(dst.Spec.Schedule, now, config.schedulePreview))
+		}
+	}
+
+	fmt.Fprintf(config.output(), "  new schedule %q: %s\n", src.Spec.Schedule, formatScheduleTimes(src.Spec.Schedule, now, config.schedulePreview))
+}
+
+//fire times are compared over a week, which covers every weekly pattern
+const scheduleCheckHorizon = 7 * 24 * time.Hour
+
+func getScheduleTimes(schedule *CronSchedule, from time.Time) []time.Time {
+	var times []time.Time
+	limit := from.Add(scheduleCheckHorizon)
+
+	for t := schedule.next(from); !t.IsZero() && t.Before(limit); t = schedule.next(t) {
+		times = append(times, t)
+	}
+
+	return times
+}
+
+func getMinimumInterval(times []time.Time) time.Duration {
+	var interval time.Duration
+
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); interval == 0 || d < interval {
+			interval = d
+		}
+	}
+
+	return interval
+}
+
+//warns about CronJobs sharing a lock label value that fire in the same minute, and about CronJobs
+//allowing concurrent runs that can run longer than the interval between two runs
+func checkScheduleRisks(objects []runtime.Object, lockLabel string, from time.Time) []string {
+	var warnings []string
+	var cronJobs []*batchv1beta1.CronJob
+	fireTimes := make(map[*batchv1beta1.CronJob][]time.Time)
+
+	for _, o := range objects {
+		cronJob, ok := o.(*batchv1beta1.CronJob)
+
+		if !ok || (cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend) {
+			continue
+		}
+
+		schedule, err := parseCronSchedule(cronJob.Spec.Schedule)
+
+		if err != nil {
+			continue
+		}
+
+		cronJobs = append(cronJobs, cronJob)
+		fireTimes[cronJob] = getScheduleTimes(schedule, from)
+	}
+
+	for i, a := range cronJobs {
+		lock, ok := a.Labels[lockLabel]
+
+		if !ok || lockLabel == "" {
+			continue
+		}
+
+		minutes := make(map[int64]bool)
+
+		for _, t := range fireTimes[a] {
+			minutes[t.Unix()/60] = true
+		}
+
+		for _, b := range cronJobs[i+1:] {
+			if b.Labels[lockLabel] != lock {
+				continue
+			}
+
+			for _, t := range fireTimes[b] {
+				if minutes[t.Unix()/60] {
+					warnings = append(warnings, fmt.Sprintf("CronJobs %q and %q share the %s=%s lock and both run at %s",
+						a.Name, b.Name, lockLabel, lock, t.Format("2006-01-02 15:04 MST")))
+					break
+				}
+			}
+		}
+	}
+
+	for _, cronJob := range cronJobs {
+		if cronJob.Spec.ConcurrencyPolicy != "" && cronJob.Spec.ConcurrencyPolicy != batchv1beta1.AllowConcurrent {
+			continue
+		}
+
+		interval := getMinimumInterval(fireTimes[cronJob])
+		deadline := cronJob.Spec.JobTemplate.Spec.ActiveDeadlineSeconds
+
+		if interval == 0 {
+			continue
+		} else if deadline == nil {
+			warnings = append(warnings, fmt.Sprintf("CronJob %q allows concurrent runs and has no activeDeadlineSeconds, runs can overlap with the next one %s later",
+				cronJob.Name, interval))
+		} else if time.Duration(*deadline)*time.Second > interval {
+			warnings = append(warnings, fmt.Sprintf("CronJob %q allows concurrent runs and can run for %s, longer than the %s between runs",
+				cronJob.Name, time.Duration(*deadline)*time.Second, interval))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const gitCommitAnnotation = "kubechange/git-commit"
+
+const (
+	gitObjectCommit   = 1
+	gitObjectTree     = 2
+	gitObjectBlob     = 3
+	gitObjectTag      = 4
+	gitObjectOfsDelta = 6
+	gitObjectRefDelta = 7
+)
+
+var gitObjectTypes = map[int]string{gitObjectCommit: "commit", gitObjectTree: "tree", gitObjectBlob: "blob", gitObjectTag: "tag"}
+
+//reads objects from the object database of a local repository, without a git binary or a checkout,
+//linked worktrees keep their HEAD in dir and share refs and objects in commonDir
+type GitRepository struct {
+	dir        string
+	commonDir  string
+	objectDirs []string
+	packs      []GitPack
+}
+
+type GitPack struct {
+	path    string
+	hashes  [][]byte
+	offsets []int64
+}
+
+type GitTreeEntry struct {
+	mode string
+	path string
+	hash string
+}
+
+func openGitRepository(dir string) (*GitRepository, error) {
+	gitDir := filepath.Join(dir, ".git")
+	info, err := os.Stat(gitDir)
+
+	if err != nil {
+		//bare repositories have no .git directory
+		if _, err := os.Stat(filepath.Join(dir, "objects")); err != nil {
+			return nil, fmt.Errorf("%s is not a git repository", dir)
+		}
+
+		gitDir = dir
+	} else if !info.IsDir() {
+		//worktrees and submodules point to their git directory
+		b, err := ioutil.ReadFile(gitDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		target := strings.TrimSpace(strings.TrimPrefix(string(b), "gitdir:"))
+
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+
+		gitDir = target
+	}
+
+	repo := &GitRepository{dir: gitDir, commonDir: gitDir}
+
+	if b, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		repo.commonDir = strings.TrimSpace(string(b))
+
+		if !filepath.IsAbs(repo.commonDir) {
+			repo.commonDir = filepath.Join(gitDir, repo.commonDir)
+		}
+	}
+
+	if err := repo.addObjectDir(filepath.Join(repo.commonDir, "objects")); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+//adds an object directory with its packs and alternates, which share objects of other repositories
+func (repo *GitRepository) addObjectDir(dir string) error {
+	for _, d := range repo.objectDirs {
+		if d == dir {
+			return nil
+		}
+	}
+
+	repo.objectDirs = append(repo.objectDirs, dir)
+	indexes, _ := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+
+	for _, index := range indexes {
+		pack, err := readGitPackIndex(index)
+
+		if err != nil {
+			return err
+		}
+
+		repo.packs = append(repo.packs, pack)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+
+	if err != nil {
+		return nil
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		alternate := strings.TrimSpace(line)
+
+		if alternate == "" || strings.HasPrefix(alternate, "#") {
+			continue
+		}
+
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(dir, alternate)
+		}
+
+		if err := repo.addObjectDir(filepath.Clean(alternate)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//reads a version 2 pack index: a fanout table, sorted hashes, checksums and offsets
+func readGitPackIndex(index string) (GitPack, error) {
+	pack := GitPack{path: strings.TrimSuffix(index, ".idx") + ".pack"}
+	b, err := ioutil.ReadFile(index)
+
+	if err != nil {
+		return pack, err
+	}
+
+	if len(b) < 8+256*4 || !bytes.Equal(b[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(b[4:8]) != 2 {
+		return pack, fmt.Errorf("%s: unsupported pack index version", index)
+	}
+
+	count := int(binary.BigEndian.Uint32(b[8+255*4:]))
+	hashesStart := 8 + 256*4
+	offsetsStart := hashesStart + count*20 + count*4
+	largeOffsetsStart := offsetsStart + count*4
+
+	if len(b) < largeOffsetsStart {
+		return pack, fmt.Errorf("%s: truncated pack index", index)
+	}
+
+	for i := 0; i < count; i++ {
+		pack.hashes = append(pack.hashes, b[hashesStart+i*20:hashesStart+i*20+20])
+		offset := int64(binary.BigEndian.Uint32(b[offsetsStart+i*4:]))
+
+		if offset&0x80000000 != 0 {
+			large := largeOffsetsStart + int(offset&0x7fffffff)*8
+
+			if len(b) < large+8 {
+				return pack, fmt.Errorf("%s: truncated pack index", index)
+			}
+
+			offset = int64(binary.BigEndian.Uint64(b[large:]))
+		}
+
+		pack.offsets = append(pack.offsets, offset)
+	}
+
+	return pack, nil
+}
+
+func (pack GitPack) find(hash []byte) (int64, bool) {
+	i := sort.Search(len(pack.hashes), func(i int) bool {
+		return bytes.Compare(pack.hashes[i], hash) >= 0
+	})
+
+	if i < len(pack.hashes) && bytes.Equal(pack.hashes[i], hash) {
+		return pack.offsets[i], true
+	}
+
+	return 0, false
+}
+
+func isGitHash(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 40
+}
+
+func (repo *GitRepository) readObject(hash string) (string, []byte, error) {
+	kind, data, err := repo.readLooseObject(hash)
+
+	if err == nil || !os.IsNotExist(err) {
+		return kind, data, err
+	}
+
+	raw, _ := hex.DecodeString(hash)
+
+	for _, pack := range repo.packs {
+		if offset, ok := pack.find(raw); ok {
+			objectType, data, err := repo.readPackedObject(pack, offset)
+			return gitObjectTypes[objectType], data, err
+		}
+	}
+
+	return "", nil, fmt.Errorf("git object %s not found", hash)
+}
+
+//loose objects are zlib compressed with a "<type> <size>\0" header
+func (repo *GitRepository) readLooseObject(hash string) (string, []byte, error) {
+	if !isGitHash(hash) {
+		return "", nil, fmt.Errorf("invalid git object hash %q", hash)
+	}
+
+	var f *os.File
+	err := os.ErrNotExist
+
+	for _, dir := range repo.objectDirs {
+		if f, err = os.Open(filepath.Join(dir, hash[:2], hash[2:])); !os.IsNotExist(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer f.Close()
+	r, err := zlib.NewReader(f)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	b, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	i := bytes.IndexByte(b, 0)
+
+	if i < 0 {
+		return "", nil, fmt.Errorf("git object %s: invalid header", hash)
+	}
+
+	header := strings.SplitN(string(b[:i]), " ", 2)
+	return header[0], b[i+1:], nil
+}
+
+//pack entries start with the type and the inflated size, and deltas are resolved against their base
+func (repo *GitRepository) readPackedObject(pack GitPack, offset int64) (int, []byte, error) {
+	f, err := os.Open(pack.path)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, offset, 1<<62))
+
+	c, err := r.ReadByte()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	objectType := int(c>>4) & 7
+	size := int64(c & 0x0f)
+
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+
+		size |= int64(c&0x7f) << shift
+	}
+
+	var baseType int
+	var base []byte
+
+	switch objectType {
+	case gitObjectOfsDelta:
+		c, err = r.ReadByte()
+		distance := int64(c & 0x7f)
+
+		for err == nil && c&0x80 != 0 {
+			c, err = r.ReadByte()
+			distance = ((distance + 1) << 7) | int64(c&0x7f)
+		}
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		baseType, base, err = repo.readPackedObject(pack, offset-distance)
+	case gitObjectRefDelta:
+		hash := make([]byte, 20)
+
+		if _, err = io.ReadFull(r, hash); err != nil {
+			return 0, nil, err
+		}
+
+		var kind string
+		kind, base, err = repo.readObject(hex.EncodeToString(hash))
+
+		for t, name := range gitObjectTypes {
+			if name == kind {
+				baseType = t
+			}
+		}
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	z, err := zlib.NewReader(r)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := ioutil.ReadAll(z)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if base == nil {
+		if int64(len(data)) != size {
+			return 0, nil, fmt.Errorf("%s: object at offset %d has an invalid size", pack.path, offset)
+		}
+
+		return objectType, data, nil
+	}
+
+	data, err = applyGitDelta(base, data)
+	return baseType, data, err
+}
+
+func readGitDeltaSize(delta []byte, i *int) int {
+	size := 0
+
+	for shift := uint(0); *i < len(delta); shift += 7 {
+		c := delta[*i]
+		*i++
+		size |= int(c&0x7f) << shift
+
+		if c&0x80 == 0 {
+			break
+		}
+	}
+
+	return size
+}
+
+//deltas are a sequence of copies from the base object and inserts of new data
+func applyGitDelta(base []byte, delta []byte) ([]byte, error) {
+	i := 0
+
+	if readGitDeltaSize(delta, &i) != len(base) {
+		return nil, errors.New("git delta base size mismatch")
+	}
+
+	target := make([]byte, 0, readGitDeltaSize(delta, &i))
+
+	for i < len(delta) {
+		c := delta[i]
+		i++
+
+		if c&0x80 != 0 {
+			var offset, size int
+
+			for bit := uint(0); bit < 7; bit++ {
+				if c&(1<<bit) == 0 {
+					continue
+				}
+
+				if i >= len(delta) {
+					return nil, errors.New("truncated git delta")
+				}
+
+				if bit < 4 {
+					offset |= int(delta[i]) << (8 * bit)
+				} else {
+					size |= int(delta[i]) << (8 * (bit - 4))
+				}
+
+				i++
+			}
+
+			if size == 0 {
+				size = 0x10000
+			}
+
+			if offset+size > len(base) {
+				return nil, errors.New("git delta copies outside of its base")
+			}
+
+			target = append(target, base[offset:offset+size]...)
+		} else if c != 0 {
+			if i+int(c) > len(delta) {
+				return nil, errors.New("truncated git delta")
+			}
+
+			target = append(target, delta[i:i+int(c)]...)
+			i += int(c)
+		} else {
+			return nil, errors.New("invalid git delta instruction")
+		}
+	}
+
+	return target, nil
+}
+
+//refs of a worktree, such as HEAD, are read before the shared refs
+func (repo *GitRepository) readRef(name string) (string, bool) {
+	for _, dir := range []string{repo.dir, repo.commonDir} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			value := strings.TrimSpace(string(b))
+
+			if strings.HasPrefix(value, "ref: ") {
+				return repo.readRef(strings.TrimPrefix(value, "ref: "))
+			}
+
+			return value, isGitHash(value)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(repo.commonDir, "packed-refs"))
+
+	if err != nil {
+		return "", false
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) == 2 && fields[1] == name && isGitHash(fields[0]) {
+			return fields[0], true
+		}
+	}
+
+	return "", false
+}
+
+//finds abbreviated hashes among loose and packed objects
+func (repo *GitRepository) findObjectsByPrefix(prefix string) []string {
+	found := make(map[string]bool)
+
+	for _, dir := range repo.objectDirs {
+		names, _ := filepath.Glob(filepath.Join(dir, prefix[:2], prefix[2:]+"*"))
+
+		for _, name := range names {
+			found[prefix[:2]+filepath.Base(name)] = true
+		}
+	}
+
+	for _, pack := range repo.packs {
+		for _, hash := range pack.hashes {
+			if s := hex.EncodeToString(hash); strings.HasPrefix(s, prefix) {
+				found[s] = true
+			}
+		}
+	}
+
+	var hashes []string
+
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
+
+//resolves a ref like git rev-parse and peels annotated tags to their commit
+func (repo *GitRepository) resolveCommit(ref string) (string, error) {
+	hash := ""
+
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref, "refs/remotes/" + ref, "refs/remotes/" + ref + "/HEAD"} {
+		if h, ok := repo.readRef(name); ok {
+			hash = h
+			break
+		}
+	}
+
+	if _, err := hex.DecodeString(ref); hash == "" && err == nil && len(ref) >= 4 && len(ref) <= 40 {
+		hashes := repo.findObjectsByPrefix(strings.ToLower(ref))
+
+		if len(hashes) > 1 {
+			return "", fmt.Errorf("ambiguous git revision %q", ref)
+		} else if len(hashes) == 1 {
+			hash = hashes[0]
+		}
+	}
+
+	if hash == "" {
+		return "", fmt.Errorf("unknown git revision %q", ref)
+	}
+
+	for {
+		kind, data, err := repo.readObject(hash)
+
+		if err != nil {
+			return "", err
+		}
+
+		if kind == "commit" {
+			return hash, nil
+		} else if kind != "tag" || !bytes.HasPrefix(data, []byte("object ")) {
+			return "", fmt.Errorf("git revision %q is a %s, not a commit", ref, kind)
+		} else if len(data) < 47 || !isGitHash(string(data[7:47])) {
+			return "", fmt.Errorf("git tag %s has an invalid object line", hash)
+		}
+
+		hash = string(data[7:47])
+	}
+}
+
+func (repo *GitRepository) readTree(hash string) ([]GitTreeEntry, error) {
+	kind, data, err := repo.readObject(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "commit" {
+		if !bytes.HasPrefix(data, []byte("tree ")) {
+			return nil, fmt.Errorf("git commit %s has no tree", hash)
+		} else if len(data) < 45 || !isGitHash(string(data[5:45])) {
+			return nil, fmt.Errorf("git commit %s has an invalid tree line", hash)
+		}
+
+		return repo.readTree(string(data[5:45]))
+	} else if kind != "tree" {
+		return nil, fmt.Errorf("git object %s is a %s, not a tree", hash, kind)
+	}
+
+	var entries []GitTreeEntry
+
+	//entries are "<mode> <name>\0<20 byte hash>"
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		null := bytes.IndexByte(data, 0)
+
+		if space < 0 || null < space || len(data) < null+21 {
+			return nil, fmt.Errorf("git tree %s is invalid", hash)
+		}
+
+		entries = append(entries, GitTreeEntry{
+			mode: string(data[:space]),
+			path: string(data[space+1 : null]),
+			hash: hex.EncodeToString(data[null+1 : null+21]),
+		})
+		data = data[null+21:]
+	}
+
+	return entries, nil
+}
+
+//lists the blobs of a commit by path, skipping submodules and symlinks
+func (repo *GitRepository) listFiles(hash string, dir string) ([]GitTreeEntry, error) {
+	entries, err := repo.readTree(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var files []GitTreeEntry
+
+	for _, entry := range entries {
+		entry.path = path.Join(dir, entry.path)
+
+		if entry.mode == "40000" {
+			subtree, err := repo.listFiles(entry.hash, entry.path)
+
+			if err != nil {
+				return nil, err
+			}
+
+			files = append(files, subtree...)
+		} else if mode, _ := strconv.ParseInt(entry.mode, 8, 32); mode&0170000 == 0100000 {
+			files = append(files, entry)
+		}
+	}
+
+	return files, nil
+}
+
+func isInGitDirectory(file string, dir string, recursive bool) bool {
+	if dir == "." {
+		return recursive || !strings.Contains(file, "/")
+	}
+
+	rel := strings.TrimPrefix(file, dir+"/")
+	return rel != file && (recursive || !strings.Contains(rel, "/"))
+}
+
+//expands paths in the commit like expandInputPaths does on disk, using the committed .kubechangeignore
+func selectGitFiles(repo *GitRepository, files []GitTreeEntry, args []string, recursive bool) ([]GitTreeEntry, error) {
+	byPath := make(map[string]GitTreeEntry)
+	ignores := []IgnoreRules{{dir: "."}}
+
+	for _, file := range files {
+		byPath[file.path] = file
+
+		if file.path == ignoreFileName {
+			_, data, err := repo.readObject(file.hash)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					ignores[0].patterns = append(ignores[0].patterns, line)
+				}
+			}
+		}
+	}
+
+	isIgnoredPath := func(file string) bool {
+		parts := strings.Split(file, "/")
+
+		for i := 1; i < len(parts); i++ {
+			if isIgnored(ignores, strings.Join(parts[:i], "/"), true) {
+				return true
+			}
+		}
+
+		return isIgnored(ignores, file, false)
+	}
+
+	seen := make(map[string]bool)
+	var selected []GitTreeEntry
+
+	for _, arg := range args {
+		arg = path.Clean(strings.TrimPrefix(filepath.ToSlash(arg), "/"))
+
+		if file, ok := byPath[arg]; ok {
+			if !seen[file.path] {
+				seen[file.path] = true
+				selected = append(selected, file)
+			}
+
+			continue
+		}
+
+		matched := false
+
+		for _, file := range files {
+			var ok bool
+
+			if hasGlobMeta(arg) {
+				ok = matchGlob(arg, file.path)
+			} else {
+				ok = isInGitDirectory(file.path, arg, recursive) && manifestExtensions[path.Ext(file.path)]
+			}
+
+			if ok && !isIgnoredPath(file.path) {
+				matched = true
+
+				if !seen[file.path] {
+					seen[file.path] = true
+					selected = append(selected, file)
+				}
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+	}
+
+	return selected, nil
+}
+
+func readGitFiles(repo *GitRepository, commit string, args []string, recursive bool) ([]ManifestFile, error) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	files, err := repo.listFiles(commit, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := selectGitFiles(repo, files, args, recursive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]ManifestFile, 0, len(selected))
+
+	for _, file := range selected {
+		_, data, err := repo.readObject(file.hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, ManifestFile{path: commit[:7] + ":" + file.path, content: string(data)})
+	}
+
+	return manifests, nil
+}
+
+func setGitCommitAnnotation(objects []runtime.Object, commit string) {
+	for _, o := range objects {
+		metadata, _ := getObjectMetadata(o)
+		annotations := metadata.GetAnnotations()
+
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+
+		annotations[gitCommitAnnotation] = commit
+		metadata.SetAnnotations(annotations)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const ignoreFileName = ".kubechangeignore"
+
+var manifestExtensions = map[string]bool{".yml": true, ".yaml": true, ".json": true}
+
+//source file and line of a parsed object, reported in plans and errors,
+//kept with the object through copies and patches and removed before it is sent to the cluster
+const sourceAnnotation = "kubechange/source"
+
+type IgnoreRules struct {
+	dir      string
+	patterns []string
+}
+
+func setObjectSource(o runtime.Object, source string) {
+	metadata, _ := getObjectMetadata(o)
+	annotations := metadata.GetAnnotations()
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	annotations[sourceAnnotation] = source
+	metadata.SetAnnotations(annotations)
+}
+
+func getObjectSource(o runtime.Object) string {
+	metadata, _ := getObjectMetadata(o)
+	return metadata.GetAnnotations()[sourceAnnotation]
+}
+
+//returns a copy of the object without its source
+func removeObjectSource(o runtime.Object) runtime.Object {
+	o = o.DeepCopyObject()
+	metadata, _ := getObjectMetadata(o)
+	annotations := metadata.GetAnnotations()
+	delete(annotations, sourceAnnotation)
+	metadata.SetAnnotations(annotations)
+
+	return o
+}
+
+func describeObjectSource(o runtime.Object) string {
+	if source := getObjectSource(o); source != "" {
+		return " (" + source + ")"
+	}
+
+	return ""
+}
+
+func readIgnoreRules(dir string) IgnoreRules {
+	rules := IgnoreRules{dir: dir}
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+
+	if err != nil {
+		return rules
+	}
+
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			rules.patterns = append(rules.patterns, line)
+		}
+	}
+
+	return rules
+}
+
+//patterns follow .gitignore: a trailing slash only matches directories, a leading ! re-includes,
+//and patterns without a slash match the base name at any depth
+func (rules IgnoreRules) matches(path string, isDir bool) bool {
+	rel, err := filepath.Rel(rules.dir, path)
+
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	rel = filepath.ToSlash(rel)
+	ignored := false
+
+	for _, pattern := range rules.patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		var matched bool
+
+		if strings.Contains(pattern, "/") {
+			matched = matchGlob(strings.TrimPrefix(pattern, "/"), rel)
+		} else {
+			matched = matchGlob(pattern, filepath.Base(rel))
+		}
+
+		if matched {
+			ignored = !negate
+		}
+	}
+
+	return ignored
+}
+
+func isIgnored(ignores []IgnoreRules, path string, isDir bool) bool {
+	for _, rules := range ignores {
+		if rules.matches(path, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+//matches slash separated paths, where a ** segment matches any number of directories
+func matchGlob(pattern string, path string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(path, "/"))
+}
+
+func matchGlobSegments(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchGlobSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	if matched, _ := filepath.Match(pattern[0], path[0]); !matched {
+		return false
+	}
+
+	return matchGlobSegments(pattern[1:], path[1:])
+}
+
+//returns whether a directory can contain paths matching the pattern, the last segment only matches files
+func matchGlobDirectory(pattern []string, dir []string) bool {
+	if len(pattern) > 0 && pattern[0] == "**" {
+		return true
+	}
+
+	if len(dir) == 0 {
+		return len(pattern) > 0
+	}
+
+	if len(pattern) <= 1 {
+		return false
+	}
+
+	if matched, _ := filepath.Match(pattern[0], dir[0]); !matched {
+		return false
+	}
+
+	return matchGlobDirectory(pattern[1:], dir[1:])
+}
+
+//walks from the longest directory prefix without wildcards, so patterns don't depend on the shell
+func expandGlob(pattern string, ignores []IgnoreRules) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	segments := strings.Split(pattern, "/")
+	i := 0
+
+	for i < len(segments) && !hasGlobMeta(segments[i]) {
+		i++
+	}
+
+	root := strings.Join(segments[:i], "/")
+
+	if root == "" && strings.HasPrefix(pattern, "/") {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+
+	var matches []string
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if isIgnored(ignores, path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		//without ** only the directories named by the pattern are walked
+		if info.IsDir() && path != root && !matchGlobDirectory(segments, strings.Split(filepath.ToSlash(path), "/")) {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() && matchGlob(pattern, filepath.ToSlash(path)) {
+			matches = append(matches, path)
+		}
+
+		return nil
+	})
+
+	return matches, err
+}
+
+func listDirectoryManifests(dir string, recursive bool, ignores []IgnoreRules) ([]string, error) {
+	var paths []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != dir && (!recursive || isIgnored(ignores, path, true)) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if manifestExtensions[filepath.Ext(path)] && !isIgnored(ignores, path, false) {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+
+	return paths, err
+}
+
+//expands directories and glob patterns into manifest paths, keeping "-" for stdin
+func expandInputPaths(args []string, recursive bool) ([]string, error) {
+	ignores := []IgnoreRules{readIgnoreRules(".")}
+	seen := make(map[string]bool)
+	var paths []string
+
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, arg := range args {
+		if arg == "-" {
+			add(arg)
+			continue
+		}
+
+		info, err := os.Stat(arg)
+
+		if err == nil && info.IsDir() {
+			found, err := listDirectoryManifests(arg, recursive, append(ignores, readIgnoreRules(arg)))
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, path := range found {
+				add(path)
+			}
+		} else if err != nil && hasGlobMeta(arg) {
+			found, err := expandGlob(arg, ignores)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if len(found) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+
+			sort.Strings(found)
+
+			for _, path := range found {
+				add(path)
+			}
+		} else {
+			add(arg)
+		}
+	}
+
+	return paths, nil
+}
+
+func readInputFile(path string) (ManifestFile, error) {
+	if path == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		return ManifestFile{path: "<stdin>", content: string(b)}, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	return ManifestFile{path: path, content: string(b)}, err
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func getJobFinishedCondition(job *batchv1.Job) *batchv1.JobCondition {
+	for i, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == v1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+
+	return nil
+}
+
+func printJobStatus(job *batchv1.Job, out io.Writer) {
+	fmt.Fprintf(out, "Job \"%s\": %d active, %d succeeded, %d failed\n", job.Name, job.Status.Active, job.Status.Succeeded, job.Status.Failed)
+}
+
+//prints the termination message of the most recently started pod of a Job
+func printJobTerminationMessage(job *batchv1.Job, config PlanConfig) {
+	var pods *v1.PodList
+	err := config.retry.do(func() error {
+		var err error
+		pods, err = config.kubeclient.CoreV1().Pods(job.Namespace).List(metav1.ListOptions{
+			LabelSelector: "controller-uid=" + string(job.UID),
+		})
+		return err
+	})
+
+	if err != nil || len(pods.Items) == 0 {
+		return
+	}
+
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+
+	pod := pods.Items[len(pods.Items)-1]
+
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+
+		if terminated == nil {
+			continue
+		}
+
+		message := terminated.Message
+
+		if message == "" {
+			message = terminated.Reason
+		}
+
+		fmt.Fprintf(config.output(), "Pod \"%s\" container \"%s\" exited with code %d: %s\n", pod.Name, status.Name, terminated.ExitCode, message)
+	}
+}
+
+//watches a Job until it completes or fails, printing pod counts as they change
+func waitForJobCompletion(job *batchv1.Job, config PlanConfig) error {
+	clientset := config.kubeclient
+	var lastStatus *batchv1.JobStatus
+	var streamer *jobLogStreamer
+
+	for {
+		var live *batchv1.Job
+
+		err := config.retry.do(func() error {
+			var err error
+			live, err = clientset.BatchV1().Jobs(job.Namespace).Get(job.Name, metav1.GetOptions{})
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if config.logs && streamer == nil {
+			streamer = startJobLogStreamer(live, config)
+			defer streamer.finish()
+		}
+
+		var watcher watch.Interface
+
+		err = config.retry.do(func() error {
+			var err error
+			watcher, err = clientset.BatchV1().Jobs(job.Namespace).Watch(metav1.ListOptions{
+				FieldSelector:   fields.OneTermEqualSelector("metadata.name", job.Name).String(),
+				ResourceVersion: live.ResourceVersion,
+			})
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+
+		events := []watch.Event{{Type: watch.Modified, Object: live}}
+
+		for {
+			var event watch.Event
+
+			if len(events) > 0 {
+				event, events = events[0], events[1:]
+			} else {
+				var ok bool
+
+				if event, ok = <-watcher.ResultChan(); !ok {
+					break
+				}
+			}
+
+			current, ok := event.Object.(*batchv1.Job)
+
+			if !ok || current.Name != job.Name {
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				watcher.Stop()
+				return fmt.Errorf("Job \"%s\" was deleted before finishing", job.Name)
+			}
+
+			if lastStatus == nil || lastStatus.Active != current.Status.Active ||
+				lastStatus.Succeeded != current.Status.Succeeded || lastStatus.Failed != current.Status.Failed {
+				printJobStatus(current, config.output())
+				lastStatus = current.Status.DeepCopy()
+			}
+
+			condition := getJobFinishedCondition(current)
+
+			if condition == nil {
+				continue
+			}
+
+			watcher.Stop()
+			printJobTerminationMessage(current, config)
+
+			if condition.Type == batchv1.JobFailed {
+				return fmt.Errorf("Job \"%s\" failed: %s", job.Name, condition.Message)
+			}
+
+			fmt.Fprintf(config.output(), "Job \"%s\" completed\n", job.Name)
+			return nil
+		}
+
+		//the API server closes watches periodically, so keep watching from the latest state
+		time.Sleep(time.Second)
+	}
+}
+
+//copies each line of a log stream prefixed with the pod and container it comes from
+func copyLogLines(prefix string, stream io.Reader, out io.Writer, lock *sync.Mutex) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		lock.Lock()
+		fmt.Fprintf(out, "[%s] %s\n", prefix, scanner.Text())
+		lock.Unlock()
+	}
+
+	return scanner.Err()
+}
+
+type jobLogStreamer struct {
+	job      *batchv1.Job
+	config   PlanConfig
+	lock     sync.Mutex
+	followed map[string]bool
+	streams  sync.WaitGroup
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+//follows the logs of the containers of a Job's pods as they start
+func startJobLogStreamer(job *batchv1.Job, config PlanConfig) *jobLogStreamer {
+	streamer := &jobLogStreamer{
+		job:      job,
+		config:   config,
+		followed: make(map[string]bool),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(streamer.stopped)
+		wait.Until(streamer.followPods, 2*time.Second, streamer.stop)
+	}()
+
+	return streamer
+}
+
+func (streamer *jobLogStreamer) followPods() {
+	pods := streamer.config.kubeclient.CoreV1().Pods(streamer.job.Namespace)
+	var list *v1.PodList
+	err := streamer.config.retry.do(func() error {
+		var err error
+		list, err = pods.List(metav1.ListOptions{LabelSelector: "controller-uid=" + string(streamer.job.UID)})
+		return err
+	})
+
+	if err != nil {
+		return
+	}
+
+	for _, pod := range list.Items {
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			prefix := pod.Name + "/" + status.Name
+
+			if streamer.followed[prefix] || (status.State.Running == nil && status.State.Terminated == nil) {
+				continue
+			}
+
+			streamer.followed[prefix] = true
+			request := pods.GetLogs(pod.Name, &v1.PodLogOptions{Container: status.Name, Follow: true})
+			streamer.streams.Add(1)
+
+			go func(prefix string) {
+				defer streamer.streams.Done()
+				stream, err := request.Stream()
+
+				if err != nil {
+					fmt.Fprintf(streamer.config.output(), "Failed to follow logs of %s: %s\n", prefix, err.Error())
+					return
+				}
+
+				defer stream.Close()
+				copyLogLines(prefix, stream, streamer.config.output(), &streamer.lock)
+			}(prefix)
+		}
+	}
+}
+
+//looks for pods one last time, then waits until every followed container log has ended
+func (streamer *jobLogStreamer) finish() {
+	close(streamer.stop)
+	<-streamer.stopped
+	streamer.followPods()
+	streamer.streams.Wait()
+}
+
+//the alphabet of generated names, without vowels and similar looking characters
+const manualJobNameAlphabet = "bcdfghjklmnpqrstvwxz2456789"
+
+//the cronjob controller names scheduled Jobs <cronjob>-<minute>, manual Jobs use
+//a random suffix instead so they never collide with a scheduled or another manual run
+func getManualJobName(cronJobName string) string {
+	suffix := make([]byte, 5)
+
+	for i := range suffix {
+		suffix[i] = manualJobNameAlphabet[rand.Intn(len(manualJobNameAlphabet))]
+	}
+
+	//job names are used as label values, limited to 63 characters
+	if len(cronJobName) > 50 {
+		cronJobName = cronJobName[:50]
+	}
+
+	return cronJobName + "-manual-" + string(suffix)
+}
+
+//builds a Job from a CronJob's jobTemplate the same way the cronjob controller does
+func getJobFromCronJob(cronJob *batchv1beta1.CronJob) *batchv1.Job {
+	labels := make(map[string]string)
+	annotations := map[string]string{"cronjob.kubernetes.io/instantiate": "manual"}
+
+	for k, v := range cronJob.Spec.JobTemplate.Labels {
+		labels[k] = v
+	}
+
+	for k, v := range cronJob.Spec.JobTemplate.Annotations {
+		annotations[k] = v
+	}
+
+	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        getManualJobName(cronJob.Name),
+			Namespace:   cronJob.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: *cronJob.Spec.JobTemplate.Spec.DeepCopy(),
+	}
+
+	if cronJob.UID != "" {
+		job.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(cronJob, batchv1beta1.SchemeGroupVersion.WithKind("CronJob")),
+		}
+	}
+
+	return job
+}
+
+//creates a one-off Job from a local CronJob if one matches the name, or from the live CronJob otherwise
+func runCronJob(name string, namespace string, localObjects []runtime.Object, config PlanConfig) error {
+	var cronJob *batchv1beta1.CronJob
+
+	for _, o := range filterObjectsByNamespace(localObjects, namespace) {
+		if local, ok := o.(*batchv1beta1.CronJob); ok && local.Name == name {
+			cronJob = local.DeepCopy()
+		}
+	}
+
+	isLocal := cronJob != nil
+
+	if !isLocal {
+		cronJob = &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+
+	if cronJob.Namespace == "" {
+		cronJob.Namespace = "default"
+	}
+
+	//the live CronJob is needed for its UID even when running a local one
+	live, err := getObject(cronJob, config)
+
+	if isLocal && errors.IsNotFound(err) {
+		fmt.Fprintln(config.output(), "CronJob \""+name+"\" is not in the cluster, the Job will have no owner")
+	} else if err != nil {
+		return err
+	} else if isLocal {
+		cronJob.UID = live.(*batchv1beta1.CronJob).UID
+	} else {
+		cronJob = live.(*batchv1beta1.CronJob)
+	}
+
+	job := getJobFromCronJob(cronJob)
+	fmt.Fprintln(config.output(), "Creating "+getObjectName(job)+" from CronJob \""+name+"\"")
+
+	if !config.execute && !config.dryRun {
+		return nil
+	}
+
+	err = createObject(job, config)
+
+	if err != nil {
+		return err
+	}
+
+	return waitForCreatedJob(job, config)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var lintSeverities = map[string]int{"info": 0, "warning": 1, "error": 2}
+
+//1 is left to manifests that cannot be read and 2 to panics
+var lintExitCodes = map[string]int{"warning": 3, "error": 4}
+
+type LintRule struct {
+	name     string
+	severity string
+	check    func(object runtime.Object) []string
+}
+
+type LintFinding struct {
+	rule     LintRule
+	object   runtime.Object
+	messages []string
+}
+
+var lintRules = []LintRule{
+	{name: "image-tag", severity: "error", check: lintImageTags},
+	{name: "resources", severity: "warning", check: lintResources},
+	{name: "restart-policy", severity: "error", check: lintRestartPolicy},
+	{name: "backoff-limit", severity: "warning", check: lintBackoffLimit},
+	{name: "active-deadline", severity: "warning", check: lintActiveDeadline},
+	{name: "concurrency-policy", severity: "warning", check: lintConcurrencyPolicy},
+	{name: "history-limits", severity: "info", check: lintHistoryLimits},
+	{name: "ttl-after-finished", severity: "info", check: lintTTLAfterFinished},
+}
+
+func getObjectJobSpec(object runtime.Object) *batchv1.JobSpec {
+	switch t := object.(type) {
+	case *batchv1.Job:
+		return &t.Spec
+	case *batchv1beta1.CronJob:
+		return &t.Spec.JobTemplate.Spec
+	}
+
+	return nil
+}
+
+func getObjectContainers(object runtime.Object) []v1.Container {
+	spec := getObjectJobSpec(object)
+
+	if spec == nil {
+		return nil
+	}
+
+	return append(append([]v1.Container{}, spec.Template.Spec.InitContainers...), spec.Template.Spec.Containers...)
+}
+
+func lintImageTags(object runtime.Object) []string {
+	var messages []string
+
+	for _, container := range getObjectContainers(object) {
+		_, suffix := splitImage(container.Image)
+
+		if suffix == "" {
+			messages = append(messages, fmt.Sprintf("container %q uses an untagged image %q", container.Name, container.Image))
+		} else if suffix == ":latest" {
+			messages = append(messages, fmt.Sprintf("container %q uses the latest tag of %q", container.Name, container.Image))
+		}
+	}
+
+	return messages
+}
+
+func lintResources(object runtime.Object) []string {
+	var messages []string
+
+	for _, container := range getObjectContainers(object) {
+		var missing []string
+
+		for _, name := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+			if _, ok := container.Resources.Requests[name]; !ok {
+				missing = append(missing, string(name)+" request")
+			}
+
+			if _, ok := container.Resources.Limits[name]; !ok {
+				missing = append(missing, string(name)+" limit")
+			}
+		}
+
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("container %q has no %s", container.Name, strings.Join(missing, ", ")))
+		}
+	}
+
+	return messages
+}
+
+func lintRestartPolicy(object runtime.Object) []string {
+	spec := getObjectJobSpec(object)
+
+	if spec != nil && (spec.Template.Spec.RestartPolicy == v1.RestartPolicyAlways || spec.Template.Spec.RestartPolicy == "") {
+		return []string{"restartPolicy must be Never or OnFailure, Always is rejected for Jobs"}
+	}
+
+	return nil
+}
+
+func lintBackoffLimit(object runtime.Object) []string {
+	if spec := getObjectJobSpec(object); spec != nil && spec.BackoffLimit == nil {
+		return []string{"backoffLimit is not set, failed pods are retried 6 times"}
+	}
+
+	return nil
+}
+
+func lintActiveDeadline(object runtime.Object) []string {
+	if spec := getObjectJobSpec(object); spec != nil && spec.ActiveDeadlineSeconds == nil {
+		return []string{"activeDeadlineSeconds is not set, a stuck Job runs forever"}
+	}
+
+	return nil
+}
+
+func lintConcurrencyPolicy(object runtime.Object) []string {
+	if cronJob, ok := object.(*batchv1beta1.CronJob); ok && (cronJob.Spec.ConcurrencyPolicy == batchv1beta1.AllowConcurrent || cronJob.Spec.ConcurrencyPolicy == "") {
+		return []string{"concurrencyPolicy Allow lets runs overlap, use Forbid or Replace"}
+	}
+
+	return nil
+}
+
+func lintHistoryLimits(object runtime.Object) []string {
+	var messages []string
+
+	if cronJob, ok := object.(*batchv1beta1.CronJob); ok {
+		if cronJob.Spec.SuccessfulJobsHistoryLimit == nil {
+			messages = append(messages, "successfulJobsHistoryLimit is not set")
+		}
+
+		if cronJob.Spec.FailedJobsHistoryLimit == nil {
+			messages = append(messages, "failedJobsHistoryLimit is not set")
+		}
+	}
+
+	return messages
+}
+
+func lintTTLAfterFinished(object runtime.Object) []string {
+	if job, ok := object.(*batchv1.Job); ok && job.Spec.TTLSecondsAfterFinished == nil {
+		return []string{"ttlSecondsAfterFinished is not set, finished Jobs are never cleaned up"}
+	}
+
+	return nil
+}
+
+func parseRuleNames(names string) (map[string]bool, error) {
+	selected := make(map[string]bool)
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		found := false
+
+		for _, rule := range lintRules {
+			found = found || rule.name == name
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+
+		selected[name] = true
+	}
+
+	return selected, nil
+}
+
+//enable lists the only rules to run, and disable removes rules from them
+func selectLintRules(enable string, disable string) ([]LintRule, error) {
+	enabled, err := parseRuleNames(enable)
+
+	if err != nil {
+		return nil, err
+	}
+
+	disabled, err := parseRuleNames(disable)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []LintRule
+
+	for _, rule := range lintRules {
+		if (len(enabled) == 0 || enabled[rule.name]) && !disabled[rule.name] {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func lintObjects(objects []runtime.Object, rules []LintRule) []LintFinding {
+	var findings []LintFinding
+
+	for _, o := range objects {
+		for _, rule := range rules {
+			if messages := rule.check(o); len(messages) > 0 {
+				findings = append(findings, LintFinding{rule: rule, object: o, messages: messages})
+			}
+		}
+	}
+
+	//most severe findings first, in the order of the objects
+	sort.SliceStable(findings, func(i, j int) bool {
+		return lintSeverities[findings[i].rule.severity] > lintSeverities[findings[j].rule.severity]
+	})
+
+	return findings
+}
+
+func printLintFindings(findings []LintFinding) {
+	counts := make(map[string]int)
+
+	for _, finding := range findings {
+		counts[finding.rule.severity]++
+
+		for _, message := range finding.messages {
+			fmt.Printf("%-8s %-20s %s%s: %s\n", finding.rule.severity, finding.rule.name, getObjectName(finding.object), describeObjectSource(finding.object), message)
+		}
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("No findings")
+	} else {
+		fmt.Printf("\n%d errors, %d warnings, %d infos\n", counts["error"], counts["warning"], counts["info"])
+	}
+}
+
+//exits with 4 for errors and 3 for warnings, ignoring severities below failOn, info findings never fail
+func getLintExitCode(findings []LintFinding, failOn string) (int, error) {
+	if failOn == "none" {
+		return 0, nil
+	} else if failOn != "warning" && failOn != "error" {
+		return 0, fmt.Errorf("unknown severity %q, expected warning, error or none", failOn)
+	}
+
+	threshold := lintSeverities[failOn]
+	code := 0
+
+	for _, finding := range findings {
+		severity := finding.rule.severity
+
+		if lintSeverities[severity] >= threshold && lintExitCodes[severity] > code {
+			code = lintExitCodes[severity]
+		}
+	}
+
+	return code, nil
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apilabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/clientcmd"
@@ -25,6 +31,31 @@ import (
 //todo: should fail if more than one resource is matched on selector (for some resources?)
 //todo: should also fail if the source resources don't match selector
 
+type ManifestFile struct {
+	path    string
+	content string
+}
+
+type ManifestDocument struct {
+	path  string
+	index int
+	line  int
+	data  []byte
+}
+
+type InputConfig struct {
+	recursive   bool
+	overlay     string
+	values      map[string]interface{}
+	chart       string
+	release     ChartRelease
+	valuesFiles []string
+	sets        []string
+	gitRepo     string
+	gitCommit   string
+	schemas     *SchemaSet
+}
+
 type PairCriteria struct {
 	label string
 }
@@ -37,50 +68,334 @@ type ObjectPair struct {
 type Step struct {
 	pair   ObjectPair
 	action string
+	fields []string
+}
+
+type StepResult struct {
+	step   Step
+	status string
+	err    error
 }
 
 //need to move clientset to a struct because clientset type checks fail when using fake clientset as argument
 type PlanConfig struct {
-	kubeclient kubernetes.Interface
-	execute    bool
+	kubeclient      kubernetes.Interface
+	execute         bool
+	continueOnError bool
+	dryRun          bool
+	rollback        bool
+	snapshotFile    string
+	retry           RetryPolicy
+	deleteTimeout   time.Duration
+	wait            bool
+	logs            bool
+	schedulePreview int
+	out             io.Writer
+}
+
+//plan and result messages go to out, which is stdout unless it is set
+func (config PlanConfig) output() io.Writer {
+	return getOutputWriter(config.out)
 }
 
-func readFiles(args []string) []string {
-	var files = make([]string, 0, 1)
+func getOutputWriter(out io.Writer) io.Writer {
+	if out == nil {
+		return os.Stdout
+	}
 
-	if args[0] == "-" {
-		b, _ := ioutil.ReadAll(os.Stdin)
-		files = append(files, string(b))
-	} else {
-		for _, f := range args {
-			b, err := ioutil.ReadFile(f)
+	return out
+}
+
+func readFiles(args []string, recursive bool) []ManifestFile {
+	var files = make([]ManifestFile, 0, 1)
+	paths, err := expandInputPaths(args, recursive)
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, path := range paths {
+		file, err := readInputFile(path)
+
+		if err != nil {
+			panic(err)
+		}
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+func isEmptyDocument(document []byte) bool {
+	for _, line := range strings.Split(string(document), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isJSONContent(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+//splits a stream of JSON values, expanding top level arrays into one document per element
+func splitJSONDocuments(file ManifestFile) ([]ManifestDocument, error) {
+	documents := make([]ManifestDocument, 0, 1)
+	content := []byte(file.content)
+	decoder := json.NewDecoder(bytes.NewReader(content))
+
+	for {
+		start := decoder.InputOffset()
+		var value json.RawMessage
+
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %s", file.path, len(documents)+1, err.Error())
+		}
+
+		start += int64(bytes.Index(content[start:], value[:1]))
+		line := bytes.Count(content[:start], []byte("\n")) + 1
+		values := []json.RawMessage{value}
+
+		if value[0] == '[' {
+			values = nil
+
+			if err := json.Unmarshal(value, &values); err != nil {
+				return nil, fmt.Errorf("%s: document %d at line %d: %s", file.path, len(documents)+1, line, err.Error())
+			}
+		}
+
+		for _, v := range values {
+			documents = append(documents, ManifestDocument{
+				path:  file.path,
+				index: len(documents) + 1,
+				line:  line,
+				data:  v,
+			})
+		}
+	}
+
+	return documents, nil
+}
+
+//splits a file on YAML document separators, skipping documents with only comments or whitespace
+func splitManifestDocuments(file ManifestFile) ([]ManifestDocument, error) {
+	documents := make([]ManifestDocument, 0, 1)
+	content := []byte(file.content)
+
+	if isJSONContent(content) {
+		return splitJSONDocuments(file)
+	}
+
+	reader := yaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(content)))
+	offset := 0
+
+	for {
+		data, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.path, err.Error())
+		}
+
+		//documents are returned verbatim, so their position in the file can be found
+		if i := bytes.Index(content[offset:], data); i >= 0 {
+			offset += i
+		}
+
+		line := bytes.Count(content[:offset], []byte("\n")) + 1
+		offset += len(data)
+
+		if isEmptyDocument(data) {
+			continue
+		}
+
+		documents = append(documents, ManifestDocument{
+			path:  file.path,
+			index: len(documents) + 1,
+			line:  line,
+			data:  data,
+		})
+	}
+
+	return documents, nil
+}
+
+func parseManifests(file ManifestFile) ([]runtime.Object, error) {
+	objects := make([]runtime.Object, 0, 1)
+	documents, err := splitManifestDocuments(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, document := range documents {
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(document.data, nil, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d at line %d: %s", document.path, document.index, document.line, err.Error())
+		}
+
+		items, err := expandListObject(obj)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d at line %d: %s", document.path, document.index, document.line, err.Error())
+		}
+
+		for _, item := range items {
+			setObjectSource(item, fmt.Sprintf("%s:%d", document.path, document.line))
+		}
+
+		objects = append(objects, items...)
+	}
+
+	return objects, nil
+}
+
+//replaces List, JobList and CronJobList objects with their items
+func expandListObject(obj runtime.Object) ([]runtime.Object, error) {
+	objects := make([]runtime.Object, 0, 1)
+
+	switch t := obj.(type) {
+	case *corev1.List:
+		for i, item := range t.Items {
+			o, _, err := scheme.Codecs.UniversalDeserializer().Decode(item.Raw, nil, nil)
 
 			if err != nil {
-				panic(err)
+				return nil, fmt.Errorf("item %d: %s", i+1, err.Error())
 			}
 
-			files = append(files, string(b))
+			items, err := expandListObject(o)
+
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %s", i+1, err.Error())
+			}
+
+			objects = append(objects, items...)
+		}
+	case *batchv1.JobList:
+		for i := range t.Items {
+			objects = append(objects, &t.Items[i])
 		}
+	case *batchv1beta1.CronJobList:
+		for i := range t.Items {
+			objects = append(objects, &t.Items[i])
+		}
+	default:
+		objects = append(objects, obj)
 	}
 
-	return files
+	return objects, nil
 }
 
-func parseManifests(file string) ([]runtime.Object, error) {
+func readObjects(filenames []string, config InputConfig) ([]runtime.Object, error) {
+	var files []ManifestFile
 	objects := make([]runtime.Object, 0, 1)
-	documents := strings.Split(file, "---")
-	for _, m := range documents {
-		if len(m) == 0 {
-			continue
+
+	if config.gitCommit != "" {
+		repo, err := openGitRepository(config.gitRepo)
+
+		if err != nil {
+			return nil, err
 		}
 
-		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(m), nil, nil)
+		files, err = readGitFiles(repo, config.gitCommit, filenames, config.recursive)
 
 		if err != nil {
 			return nil, err
 		}
+	} else if len(filenames) > 0 {
+		files = readFiles(filenames, config.recursive)
+	}
 
-		objects = append(objects, obj)
+	for i := range files {
+		if config.values != nil {
+			file, err := substituteVariables(files[i], config.values)
+
+			if err != nil {
+				return nil, err
+			}
+
+			files[i] = file
+		}
+	}
+
+	if config.schemas != nil {
+		if err := validateManifestSchemas(files, config.schemas); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range files {
+		o, err := parseManifests(files[i])
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, o...)
+	}
+
+	if config.gitCommit != "" {
+		setGitCommitAnnotation(objects, config.gitCommit)
+	}
+
+	if config.chart != "" {
+		values, err := loadChartValues(config.chart, config.valuesFiles, config.sets)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rendered, err := renderChart(config.chart, config.release, values)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if config.schemas != nil {
+			if err := validateManifestSchemas(rendered, config.schemas); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, file := range rendered {
+			o, err := parseManifests(file)
+
+			if err != nil {
+				return nil, err
+			}
+
+			objects = append(objects, o...)
+		}
+	}
+
+	if config.overlay != "" {
+		overlay, err := readOverlay(config.overlay)
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects, err = applyOverlay(objects, overlay)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := validateObjects(objects)
+
+	if err != nil {
+		return nil, err
 	}
 
 	return objects, nil
@@ -102,7 +417,13 @@ func validateObjects(objects []runtime.Object) error {
 	for _, o := range objects {
 		gvk := getObjectGroupVersionKind(o)
 		if gvk.Group == "" {
-			return errors.New("Not an accepted resource")
+			return errors.New("Not an accepted resource" + describeObjectSource(o))
+		}
+
+		if cronJob, ok := o.(*batchv1beta1.CronJob); ok {
+			if _, err := parseCronSchedule(cronJob.Spec.Schedule); err != nil {
+				return fmt.Errorf("Invalid schedule %q in CronJob %q%s: %s", cronJob.Spec.Schedule, cronJob.Name, describeObjectSource(o), err.Error())
+			}
 		}
 	}
 	return nil
@@ -151,15 +472,73 @@ func main() {
 	//todo: exit status, write to stderr, embed version and build
 	flag.Usage = func() {
 		fmt.Println("Usage: kubechange -l <label> <file> ...")
+		fmt.Println("       kubechange undo")
+		fmt.Println("       kubechange run <cronjob> [<file> ...]")
+		fmt.Println("       kubechange suspend|resume -l <label>")
+		fmt.Println("       kubechange lint [<file> ...]")
 		fmt.Printf("kubechange helps keep local and remote Kubernetes state up-to-date\n\n")
 		fmt.Println("-l string\tLabel to use as a filter")
 		fmt.Println("-n string\tNamespace of compared resources")
 		fmt.Println("-e string\tUpdate cluster objects")
+		fmt.Println("-wait\tWait for created Jobs to finish and fail if a Job fails")
+		fmt.Println("-logs\tFollow the logs of created Jobs until they finish")
+		fmt.Println("-schedule-preview int\tNumber of upcoming runs shown for changed CronJob schedules")
+		fmt.Println("-lock-label string\tLabel naming the resource locked by a CronJob, used to warn about colliding runs")
+		fmt.Println("-server-dry-run\tSend cluster updates with dryRun=All to check that the API server accepts them")
+		fmt.Println("-continue-on-error\tKeep executing the steps that do not depend on a failed step")
+		fmt.Println("-rollback\tRestore changed cluster objects if a step fails")
+		fmt.Println("-snapshot-file string\tFile to save the last run snapshots to, read by undo")
+		fmt.Println("-delete-timeout duration\tMaximum time to wait for a deleted object to be removed")
+		fmt.Println("-retries int\tAttempts for API calls failing with transient errors")
+		fmt.Println("-retry-deadline duration\tMaximum time spent retrying an API call")
+		fmt.Println("-R\tRead manifests in directory arguments recursively")
+		fmt.Println("-substitute\tReplace ${VAR} and {{ .Values.var }} in manifests with values and environment variables")
+		fmt.Println("-values value\tValues file used for substitution, can be repeated")
+		fmt.Println("-set value\tValue used for substitution as key=value, can be repeated")
+		fmt.Println("-chart string\tLocal Helm chart directory rendered with -values and --set")
+		fmt.Println("-release string\tRelease name used to render the chart")
+		fmt.Println("-git-ref string\tRead manifests from this git revision instead of the working tree, arguments are paths in the revision")
+		fmt.Println("-git-repo string\tLocal git repository read by -git-ref")
+		fmt.Println("-schema string\tOpenAPI schema saved from the cluster's /openapi/v2, used instead of the bundled schema")
+		fmt.Println("-overlay string\tOverlay file with patches and overrides applied to the manifests")
+		fmt.Println("-policy string\tPolicy file with rules that block execution when violated")
+		fmt.Println("-enable string\tComma separated lint rules to run instead of every rule")
+		fmt.Println("-disable string\tComma separated lint rules to skip")
+		fmt.Println("-fail-on string\tLowest lint severity that makes lint exit with an error: warning, error or none")
+		fmt.Println("-o string\tWrite the plan to stdout as json or yaml, other output goes to stderr")
+		fmt.Println("-report string\tWrite the plan as a markdown report to this file, for pull request comments")
 	}
 
 	label := flag.String("l", "", "Label to use as filter")
 	namespace := flag.String("n", "", "Namespace of compared resources")
 	execute := flag.Bool("e", false, "Update cluster objects")
+	waitForJobs := flag.Bool("wait", false, "Wait for created Jobs to finish and fail if a Job fails")
+	followLogs := flag.Bool("logs", false, "Follow the logs of created Jobs until they finish")
+	schedulePreview := flag.Int("schedule-preview", 3, "Number of upcoming runs shown for changed CronJob schedules")
+	lockLabel := flag.String("lock-label", "kubechange/lock", "Label naming the resource locked by a CronJob, used to warn about colliding runs")
+	serverDryRun := flag.Bool("server-dry-run", false, "Send cluster updates with dryRun=All to check that the API server accepts them")
+	continueOnError := flag.Bool("continue-on-error", false, "Keep executing the steps that do not depend on a failed step")
+	rollback := flag.Bool("rollback", false, "Restore changed cluster objects if a step fails")
+	deleteTimeout := flag.Duration("delete-timeout", 60*time.Second, "Maximum time to wait for a deleted object to be removed")
+	retries := flag.Int("retries", 5, "Attempts for API calls failing with transient errors")
+	recursive := flag.Bool("R", false, "Read manifests in directory arguments recursively")
+	substitute := flag.Bool("substitute", false, "Replace ${VAR} and {{ .Values.var }} in manifests with values and environment variables")
+	var valuesFiles, sets StringList
+	flag.Var(&valuesFiles, "values", "Values file used for substitution, can be repeated")
+	flag.Var(&sets, "set", "Value used for substitution as key=value, can be repeated")
+	chart := flag.String("chart", "", "Local Helm chart directory rendered with -values and --set")
+	release := flag.String("release", "kubechange", "Release name used to render the chart")
+	gitRef := flag.String("git-ref", "", "Read manifests from this git revision instead of the working tree, arguments are paths in the revision")
+	gitRepo := flag.String("git-repo", ".", "Local git repository read by -git-ref")
+	schemaFile := flag.String("schema", "", "OpenAPI schema saved from the cluster's /openapi/v2, used instead of the bundled schema")
+	overlayFile := flag.String("overlay", "", "Overlay file with patches and overrides applied to the manifests")
+	policyFile := flag.String("policy", "", "Policy file with rules that block execution when violated")
+	enableRules := flag.String("enable", "", "Comma separated lint rules to run instead of every rule")
+	disableRules := flag.String("disable", "", "Comma separated lint rules to skip")
+	failOn := flag.String("fail-on", "warning", "Lowest lint severity that makes lint exit with an error: warning, error or none")
+	retryDeadline := flag.Duration("retry-deadline", 2*time.Minute, "Maximum time spent retrying an API call")
+	outputFormat := flag.String("o", "", "Write the plan to stdout as json or yaml, other output goes to stderr")
+	reportFile := flag.String("report", "", "Write the plan as a markdown report to this file, for pull request comments")
 
 	homedir := os.Getenv("HOME")
 
@@ -175,19 +554,136 @@ func main() {
 		kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file")
 	}
 
-	flag.Parse()
+	snapshotFile := flag.String("snapshot-file", filepath.Join(homedir, ".kube", "kubechange-last-run.json"), "File to save the last run snapshots to, read by undo")
+
+	commands := map[string]bool{"undo": true, "run": true, "suspend": true, "resume": true, "lint": true}
+	command := ""
+	args := os.Args[1:]
+
+	if len(args) > 0 && commands[args[0]] {
+		command = args[0]
+		args = args[1:]
+	}
+
+	flag.CommandLine.Parse(args)
 
 	filenames := flag.Args()
 
-	if len(filenames) == 0 {
+	//flag parsing stops at the CronJob name, so the flags following it are parsed too
+	if command == "run" && len(filenames) > 0 {
+		flag.CommandLine.Parse(filenames[1:])
+		filenames = append([]string{filenames[0]}, flag.Args()...)
+
+		for _, filename := range filenames[1:] {
+			if strings.HasPrefix(filename, "-") {
+				panic(fmt.Errorf("Flag %s follows a manifest file, flags must come before the manifest files", filename))
+			}
+		}
+	}
+
+	if ((command == "" || command == "lint") && len(filenames) == 0 && *chart == "" && *gitRef == "") || (command == "run" && len(filenames) == 0) {
 		flag.Usage()
 		return
 	}
 
-	if *label == "" {
+	if (command == "" || command == "suspend" || command == "resume") && *label == "" {
 		panic(errors.New("Missing label"))
 	}
 
+	if !isValidOutputFormat(*outputFormat) {
+		panic(fmt.Errorf("Unknown output format %q, expected json or yaml", *outputFormat))
+	}
+
+	//the structured plan is the only output on stdout
+	var out io.Writer = os.Stdout
+
+	if *outputFormat != "" {
+		out = os.Stderr
+	}
+
+	chartNamespace := *namespace
+
+	if chartNamespace == "" {
+		chartNamespace = "default"
+	}
+
+	inputConfig := InputConfig{
+		recursive:   *recursive,
+		overlay:     *overlayFile,
+		chart:       *chart,
+		release:     ChartRelease{Name: *release, Namespace: chartNamespace, Service: "Helm", IsInstall: true, Revision: 1},
+		valuesFiles: valuesFiles,
+		sets:        sets,
+		gitRepo:     *gitRepo,
+		schemas:     newBundledSchemaSet(),
+	}
+
+	var err error
+
+	if *schemaFile != "" {
+		inputConfig.schemas, err = loadSchemaFile(*schemaFile)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *gitRef != "" {
+		repo, err := openGitRepository(*gitRepo)
+
+		if err != nil {
+			panic(err)
+		}
+
+		inputConfig.gitCommit, err = repo.resolveCommit(*gitRef)
+
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Fprintf(out, "Reading manifests from %s at commit %s\n\n", *gitRef, inputConfig.gitCommit)
+	}
+
+	//values and --set render the chart when one is given, and only substitute manifest variables with -substitute
+	if *substitute || (*chart == "" && (len(valuesFiles) > 0 || len(sets) > 0)) {
+		inputConfig.values, err = loadValues(os.Environ(), valuesFiles, sets)
+
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if command == "lint" {
+		rules, err := selectLintRules(*enableRules, *disableRules)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		localObjects, err := readObjects(filenames, inputConfig)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		if *label != "" {
+			localObjects = filterObjectsByLabel(localObjects, *label)
+		}
+
+		findings := lintObjects(filterObjectsByNamespace(localObjects, *namespace), rules)
+		printLintFindings(findings)
+		code, err := getLintExitCode(findings, *failOn)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		os.Exit(code)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
 	if err != nil {
@@ -200,21 +696,95 @@ func main() {
 		panic(err.Error())
 	}
 
-	files := readFiles(filenames)
-	localObjects := make([]runtime.Object, 0, 1)
+	planConfig := PlanConfig{
+		kubeclient:      clientset,
+		execute:         *execute && !*serverDryRun,
+		continueOnError: *continueOnError,
+		dryRun:          *serverDryRun,
+		rollback:        *rollback,
+		snapshotFile:    *snapshotFile,
+		retry:           RetryPolicy{attempts: *retries, deadline: *retryDeadline, out: out},
+		deleteTimeout:   *deleteTimeout,
+		wait:            *waitForJobs,
+		logs:            *followLogs,
+		schedulePreview: *schedulePreview,
+		out:             out,
+	}
+
+	if command == "undo" {
+		if *execute != true {
+			fmt.Fprintf(out, "This is a preview. Run kubechange undo with -e to make cluster updates.\n\n")
+		}
+
+		err := undoLastRun(*snapshotFile, planConfig)
 
-	for i := range files {
-		o, err := parseManifests(files[i])
 		if err != nil {
 			panic(err)
 		}
-		localObjects = append(localObjects, o...)
+
+		return
+	}
+
+	if command == "suspend" || command == "resume" {
+		if *execute != true {
+			fmt.Printf("This is a preview. Run kubechange %s with -e to make cluster updates.\n\n", command)
+		}
+
+		if command == "suspend" {
+			err = suspendCronJobs(*label, *namespace, planConfig)
+		} else {
+			err = resumeCronJobs(*label, *namespace, planConfig)
+		}
+
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		return
 	}
 
-	err = validateObjects(localObjects)
+	if command == "run" {
+		var localObjects []runtime.Object
+
+		if len(filenames) > 1 {
+			localObjects, err = readObjects(filenames[1:], inputConfig)
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+
+		if *execute != true {
+			fmt.Fprintf(out, "This is a preview. Run kubechange run with -e to make cluster updates.\n\n")
+		}
+
+		err := runCronJob(filenames[0], *namespace, localObjects, planConfig)
+
+		if err != nil {
+			fmt.Fprintln(out, err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	localObjects, err := readObjects(filenames, inputConfig)
 
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	var policy Policy
+
+	if *policyFile != "" {
+		policy, err = readPolicy(*policyFile)
+
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	srcObjects := filterObjectsByLabel(filterObjectsByNamespace(localObjects, *namespace), *label)
@@ -224,15 +794,13 @@ func main() {
 	remoteObjects := make([]runtime.Object, 0, 1)
 
 	for _, ns := range namespaces {
-		jobs, _ := clientset.BatchV1().Jobs(ns).List(metav1.ListOptions{})
-		for i := range jobs.Items {
-			remoteObjects = append(remoteObjects, &jobs.Items[i])
-		}
+		objects, err := listObjects(ns, planConfig)
 
-		cronjobs, _ := clientset.BatchV1beta1().CronJobs(ns).List(metav1.ListOptions{})
-		for i := range cronjobs.Items {
-			remoteObjects = append(remoteObjects, &cronjobs.Items[i])
+		if err != nil {
+			panic(err)
 		}
+
+		remoteObjects = append(remoteObjects, objects...)
 	}
 
 	dstObjects := filterObjectsByLabel(filterObjectsByNamespace(remoteObjects, *namespace), *label)
@@ -241,9 +809,38 @@ func main() {
 
 	plan := generatePlan(pairs)
 
-	if *execute != true {
-		fmt.Printf("This is a preview. Run kubechange with -e to make cluster updates.\n\n")
+	for _, warning := range checkScheduleRisks(localObjects, *lockLabel, time.Now().UTC()) {
+		fmt.Fprintln(out, "Warning: "+warning)
+	}
+
+	policyBlocked := reportPolicyViolations(evaluatePolicy(policy, srcObjects, plan, time.Now()), out)
+
+	if policyBlocked && (planConfig.execute || planConfig.dryRun) {
+		fmt.Fprintln(out, "Policy violations block execution, fix or waive them to continue")
+		os.Exit(1)
 	}
 
-	executePlan(plan, PlanConfig{clientset, *execute})
+	if *serverDryRun {
+		fmt.Fprintf(out, "This is a server-side dry run. No cluster objects will be changed.\n\n")
+	} else if *execute != true {
+		fmt.Fprintf(out, "This is a preview. Run kubechange with -e to make cluster updates.\n\n")
+	}
+
+	results := executePlan(plan, planConfig)
+
+	if *outputFormat != "" {
+		if err := writePlanOutput(os.Stdout, *outputFormat, getPlanOutput(results, planConfig, inputConfig.gitCommit)); err != nil {
+			panic(err)
+		}
+	}
+
+	if *reportFile != "" {
+		if err := writeMarkdownReport(*reportFile, results, planConfig, inputConfig.gitCommit); err != nil {
+			panic(err)
+		}
+	}
+
+	if hasFailedSteps(results) || policyBlocked {
+		os.Exit(1)
+	}
 }
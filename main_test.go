@@ -1,12 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	clienttesting "k8s.io/client-go/testing"
 
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 )
@@ -74,7 +94,7 @@ func getExampleCronJobs() (batchv1beta1.CronJob, batchv1beta1.CronJob) {
 }
 
 func TestParsing(t *testing.T) {
-	files := readFiles([]string{"example-test-job.yml"})
+	files := readFiles([]string{"example-test-job.yml"}, false)
 
 	if len(files) != 1 {
 		t.Errorf("Failed to read files")
@@ -100,7 +120,7 @@ func TestParsing(t *testing.T) {
 }
 
 func TestFiltering(t *testing.T) {
-	files := readFiles([]string{"example-test-job.yml"})
+	files := readFiles([]string{"example-test-job.yml"}, false)
 
 	for _, file := range files {
 		objects, _ := parseManifests(file)
@@ -175,7 +195,7 @@ func TestCompare(t *testing.T) {
 }
 
 func TestPrePlan(t *testing.T) {
-	files := readFiles([]string{"example-test-job.yml"})
+	files := readFiles([]string{"example-test-job.yml"}, false)
 	for _, file := range files {
 		objects, _ := parseManifests(file)
 		filteredObjects := filterObjectsByLabel(objects, "kronjob/job")
@@ -225,7 +245,7 @@ func TestPlan(t *testing.T) {
 			t.Errorf("Incorrect plan action, expected update")
 		}
 
-		executePlan(plan, PlanConfig{clientset, false})
+		executePlan(plan, PlanConfig{kubeclient: clientset, execute: false})
 	}
 
 	{
@@ -240,7 +260,1690 @@ func TestPlan(t *testing.T) {
 			t.Errorf("Incorrect plan action, expected create")
 		}
 
-		executePlan(plan, PlanConfig{clientset, false})
+		executePlan(plan, PlanConfig{kubeclient: clientset, execute: false})
 	}
 
 }
+
+func TestExecutePlanContinueOnError(t *testing.T) {
+	cronJobFoo, cronJobBar := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace = "foo", "default"
+	cronJobBar.Name, cronJobBar.Namespace = "bar", "default"
+	existing := cronJobFoo.DeepCopy()
+	foo := runtime.Object(&cronJobFoo)
+	bar := runtime.Object(&cronJobBar)
+
+	plan := generatePlan([]ObjectPair{{&foo, nil}, {&bar, nil}})
+
+	{
+		clientset := fakeclientset.NewSimpleClientset(existing)
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true, continueOnError: true})
+
+		if len(results) != 2 || results[0].status != "failed" || results[1].status != "succeeded" {
+			t.Errorf("Expected failed and succeeded steps, got %v", results)
+		}
+
+		if !hasFailedSteps(results) {
+			t.Errorf("Expected failed steps to be reported")
+		}
+	}
+
+	{
+		clientset := fakeclientset.NewSimpleClientset(existing)
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true})
+
+		if len(results) != 2 || results[0].status != "failed" || results[1].status != "skipped" {
+			t.Errorf("Expected failed and skipped steps, got %v", results)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	cronJobFoo, cronJobBar := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace = "foo", "default"
+	cronJobBar.Name, cronJobBar.Namespace = "bar", "default"
+	existing := cronJobFoo.DeepCopy()
+	foo := runtime.Object(&cronJobFoo)
+	bar := runtime.Object(&cronJobBar)
+
+	plan := generatePlan([]ObjectPair{{&bar, nil}, {&foo, nil}})
+	clientset := fakeclientset.NewSimpleClientset(existing)
+	snapshotFile := filepath.Join(t.TempDir(), "last-run.json")
+	ioutil.WriteFile(snapshotFile, []byte("[]"), 0600)
+	results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true, rollback: true, snapshotFile: snapshotFile})
+
+	if len(results) != 2 || results[0].status != "rolled back" || results[1].status != "failed" {
+		t.Errorf("Expected rolled back and failed steps, got %v", results)
+	}
+
+	if _, err := clientset.BatchV1beta1().CronJobs("default").Get("bar", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("Expected created CronJob to be rolled back")
+	}
+
+	if _, err := clientset.BatchV1beta1().CronJobs("default").Get("foo", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected existing CronJob to be kept")
+	}
+
+	//a run that was rolled back leaves nothing to undo
+	if _, err := os.Stat(snapshotFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the snapshot file to be removed after a rollback, got %v", err)
+	}
+
+	clientset = fakeclientset.NewSimpleClientset()
+	executePlan(plan[:1], PlanConfig{kubeclient: clientset, execute: true, snapshotFile: snapshotFile})
+	snapshots, err := loadSnapshots(snapshotFile)
+
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("Failed to load saved snapshots: %v", err)
+	}
+
+	if snapshots[0].action != "create" || snapshots[0].created == nil || snapshots[0].previous != nil {
+		t.Errorf("Invalid snapshot loaded")
+	}
+
+	err = undoLastRun(snapshotFile, PlanConfig{kubeclient: clientset, execute: true})
+
+	if err != nil {
+		t.Errorf("Failed to undo last run: %v", err)
+	}
+
+	if _, err := clientset.BatchV1beta1().CronJobs("default").Get("bar", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("Expected undo to delete created CronJob")
+	}
+}
+
+func TestStripServerFields(t *testing.T) {
+	manualSelector := false
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "1", UID: "abc"},
+		Spec: batchv1.JobSpec{
+			ManualSelector: &manualSelector,
+			Selector:       &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "abc"}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"controller-uid": "abc", "app": "foo"}},
+			},
+		},
+		Status: batchv1.JobStatus{Active: 1},
+	}
+
+	stripped := stripServerFields(&job).(*batchv1.Job)
+
+	if stripped.ResourceVersion != "" || stripped.UID != "" || stripped.Spec.Selector != nil || stripped.Status.Active != 0 {
+		t.Errorf("Failed to strip server fields")
+	}
+
+	if _, ok := stripped.Spec.Template.Labels["controller-uid"]; ok || stripped.Spec.Template.Labels["app"] != "foo" {
+		t.Errorf("Incorrect template labels after stripping server fields")
+	}
+
+	if job.ResourceVersion != "1" {
+		t.Errorf("Original object was modified")
+	}
+}
+
+func TestPatchUpdate(t *testing.T) {
+	cronJobFoo, cronJobBar := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace = "foo", "default"
+	cronJobBar.Name, cronJobBar.Namespace = "foo", "default"
+	cronJobBar.Labels = map[string]string{"owner": "cluster"}
+	clientset := fakeclientset.NewSimpleClientset(cronJobBar.DeepCopy())
+	foo := runtime.Object(&cronJobFoo)
+	bar := runtime.Object(&cronJobBar)
+
+	plan := generatePlan([]ObjectPair{{&foo, &bar}})
+
+	if len(plan) != 1 || plan[0].action != "update" {
+		t.Fatalf("Expected an update step")
+	}
+
+	results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true})
+
+	if hasFailedSteps(results) {
+		t.Fatalf("Failed to patch CronJob: %v", results[0].err)
+	}
+
+	live, _ := clientset.BatchV1beta1().CronJobs("default").Get("foo", metav1.GetOptions{})
+
+	if live.Spec.Schedule != cronJobFoo.Spec.Schedule {
+		t.Errorf("Expected schedule to be patched")
+	}
+
+	if live.Labels["owner"] != "cluster" {
+		t.Errorf("Expected live-only labels to be kept")
+	}
+
+	if _, ok := live.Annotations[lastAppliedAnnotation]; !ok {
+		t.Errorf("Expected last applied configuration annotation")
+	}
+
+	jobFoo := batchv1.Job{Spec: cronJobFoo.Spec.JobTemplate.Spec}
+	jobBar := batchv1.Job{Spec: cronJobBar.Spec.JobTemplate.Spec}
+
+	if !hasImmutableFieldChanges(&jobFoo, &jobBar) {
+		t.Errorf("Expected Job pod template change to require replacement")
+	}
+
+	var activeDeadlineSeconds int64 = 30
+	jobBar = *jobFoo.DeepCopy()
+	jobBar.Spec.ActiveDeadlineSeconds = &activeDeadlineSeconds
+
+	if hasImmutableFieldChanges(&jobFoo, &jobBar) {
+		t.Errorf("Expected Job activeDeadlineSeconds change to be patched")
+	}
+
+	jobBar.Name = "foo"
+	jobFoo.Name = "foo-v2"
+	var renamed, existing runtime.Object = &jobFoo, &jobBar
+	plan = generatePlan([]ObjectPair{{&renamed, &existing}})
+
+	if len(plan) != 1 || plan[0].action != "replace" {
+		t.Errorf("Expected a renamed Job to be replaced, got %v", plan)
+	}
+}
+
+func TestServerDryRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Query().Get("dryRun") != "All" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if strings.Contains(string(body), `"name":"foo"`) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"denied by webhook","reason":"Invalid","code":422}`)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cronJobFoo, cronJobBar := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace = "foo", "default"
+	cronJobBar.Name, cronJobBar.Namespace = "bar", "default"
+	foo := runtime.Object(&cronJobFoo)
+	bar := runtime.Object(&cronJobBar)
+
+	plan := generatePlan([]ObjectPair{{&foo, nil}, {&bar, nil}})
+	results := executePlan(plan, PlanConfig{kubeclient: clientset, dryRun: true})
+
+	if len(results) != 2 || results[0].status != "failed" || results[1].status != "succeeded" {
+		t.Fatalf("Expected rejected and accepted steps, got %v", results)
+	}
+
+	if !strings.Contains(results[0].err.Error(), "denied by webhook") {
+		t.Errorf("Expected server-side rejection message, got %v", results[0].err)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	cronJobFoo, cronJobBar := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace = "foo", "default"
+	cronJobBar.Name, cronJobBar.Namespace = "foo", "default"
+	cronJobBar.ResourceVersion = "1"
+	foo := runtime.Object(&cronJobFoo)
+	bar := runtime.Object(&cronJobBar)
+	plan := generatePlan([]ObjectPair{{&foo, &bar}})
+	defer func(backoff wait.Backoff) { conflictBackoff = backoff }(conflictBackoff)
+	conflictBackoff.Duration = time.Millisecond
+
+	{
+		clientset := fakeclientset.NewSimpleClientset(cronJobBar.DeepCopy())
+		conflicts := 0
+		clientset.PrependReactor("patch", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			patch := string(action.(clienttesting.PatchAction).GetPatch())
+
+			if conflicts == 0 {
+				conflicts++
+				return true, nil, errors.NewConflict(schema.GroupResource{Group: "batch", Resource: "cronjobs"}, "foo", fmt.Errorf("stale"))
+			}
+
+			if !strings.Contains(patch, `"resourceVersion":"1"`) {
+				t.Errorf("Expected live resourceVersion in patch, got %s", patch)
+			}
+
+			return false, nil, nil
+		})
+
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true})
+
+		if hasFailedSteps(results) {
+			t.Errorf("Expected conflicting update to be retried: %v", results[0].err)
+		}
+	}
+
+	{
+		clientset := fakeclientset.NewSimpleClientset(cronJobBar.DeepCopy())
+		changed := cronJobBar.DeepCopy()
+		changed.Spec.Schedule = cronJobFoo.Spec.Schedule
+		clientset.PrependReactor("get", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			return true, changed, nil
+		})
+		clientset.PrependReactor("patch", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.NewConflict(schema.GroupResource{Group: "batch", Resource: "cronjobs"}, "foo", fmt.Errorf("stale"))
+		})
+
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true})
+
+		if !hasFailedSteps(results) || !strings.Contains(results[0].err.Error(), "changed since the plan") {
+			t.Errorf("Expected update to abort when the diff changed, got %v", results[0].err)
+		}
+	}
+
+	{
+		clientset := fakeclientset.NewSimpleClientset(cronJobBar.DeepCopy())
+		changed := cronJobBar.DeepCopy()
+		changed.Spec.Schedule = "0 * * * *"
+		clientset.PrependReactor("get", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			return true, changed, nil
+		})
+		clientset.PrependReactor("patch", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.NewConflict(schema.GroupResource{Group: "batch", Resource: "cronjobs"}, "foo", fmt.Errorf("stale"))
+		})
+
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true})
+
+		if !hasFailedSteps(results) || !strings.Contains(results[0].err.Error(), "no longer the planned ones") {
+			t.Errorf("Expected update to abort when a planned field has a new value, got %v", results[0].err)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	defer func(backoff wait.Backoff) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff.Duration = time.Millisecond
+	policy := RetryPolicy{attempts: 3, deadline: time.Minute}
+
+	{
+		attempts := 0
+		err := policy.do(func() error {
+			attempts++
+			if attempts < 3 {
+				return errors.NewServiceUnavailable("unavailable")
+			}
+			return nil
+		})
+
+		if err != nil || attempts != 3 {
+			t.Errorf("Expected transient errors to be retried, got %d attempts and %v", attempts, err)
+		}
+	}
+
+	{
+		attempts := 0
+		err := policy.do(func() error {
+			attempts++
+			return errors.NewInternalError(fmt.Errorf("internal"))
+		})
+
+		if err == nil || attempts != 3 {
+			t.Errorf("Expected retries to stop after 3 attempts, got %d", attempts)
+		}
+	}
+
+	{
+		attempts := 0
+		err := policy.do(func() error {
+			attempts++
+			return errors.NewBadRequest("bad request")
+		})
+
+		if err == nil || attempts != 1 {
+			t.Errorf("Expected non-transient errors not to be retried, got %d attempts", attempts)
+		}
+	}
+
+	clientset := fakeclientset.NewSimpleClientset()
+	failures := 0
+	clientset.PrependReactor("list", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if failures < 2 {
+			failures++
+			return true, nil, errors.NewTooManyRequests("slow down", 0)
+		}
+		return false, nil, nil
+	})
+
+	_, err := listObjects("default", PlanConfig{kubeclient: clientset, retry: policy})
+
+	if err != nil || failures != 2 {
+		t.Errorf("Expected List to be retried, got %v", err)
+	}
+
+	//the first create is persisted but times out, the retry finds the object it sent
+	var created runtime.Object
+	clientset.PrependReactor("create", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if created != nil {
+			return true, nil, errors.NewAlreadyExists(schema.GroupResource{Group: "batch", Resource: "jobs"}, "foo")
+		}
+		created = action.(clienttesting.CreateAction).GetObject()
+		return true, nil, errors.NewServerTimeout(schema.GroupResource{Group: "batch", Resource: "jobs"}, "create", 0)
+	})
+	clientset.PrependReactor("get", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, created, nil
+	})
+
+	job := runtime.Object(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}})
+
+	if err := createObject(getAppliedObject(job), PlanConfig{kubeclient: clientset, retry: policy}); err != nil {
+		t.Errorf("Expected a retried create of the same object to succeed, got %v", err)
+	}
+
+	job.(*batchv1.Job).Spec.Parallelism = &[]int32{2}[0]
+
+	if err := createObject(getAppliedObject(job), PlanConfig{kubeclient: clientset, retry: policy}); !errors.IsAlreadyExists(err) {
+		t.Errorf("Expected a create conflicting with another object to fail, got %v", err)
+	}
+
+	//the first delete is persisted but times out, the retry no longer finds the object
+	deletes := 0
+	clientset = fakeclientset.NewSimpleClientset()
+	clientset.PrependReactor("delete", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		deletes++
+		if deletes == 1 {
+			return true, nil, errors.NewServerTimeout(schema.GroupResource{Group: "batch", Resource: "jobs"}, "delete", 0)
+		}
+		return true, nil, errors.NewNotFound(schema.GroupResource{Group: "batch", Resource: "jobs"}, "foo")
+	})
+
+	if err := deleteObject(job, PlanConfig{kubeclient: clientset, retry: policy}); err != nil || deletes != 2 {
+		t.Errorf("Expected a retried delete of a deleted object to succeed, got %v", err)
+	}
+
+	if err := deleteObject(job, PlanConfig{kubeclient: fakeclientset.NewSimpleClientset(), retry: policy}); !errors.IsNotFound(err) {
+		t.Errorf("Expected a delete of a missing object to fail, got %v", err)
+	}
+}
+
+func TestDeletionTimeout(t *testing.T) {
+	job := batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "abc"}}
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo-1", Namespace: "default", Labels: map[string]string{"controller-uid": "abc"}}}
+	clientset := fakeclientset.NewSimpleClientset(job.DeepCopy(), pod.DeepCopy())
+	clientset.PrependReactor("delete", "jobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+
+	dependents, kind, err := countObjectDependents(&job, PlanConfig{kubeclient: clientset})
+
+	if err != nil || dependents != 1 || kind != "pods" {
+		t.Errorf("Expected 1 dependent pod, got %d %s", dependents, kind)
+	}
+
+	dst := runtime.Object(&job)
+	plan := generatePlan([]ObjectPair{{nil, &dst}})
+	results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true, deleteTimeout: 10 * time.Millisecond})
+
+	if !hasFailedSteps(results) || !strings.Contains(results[0].err.Error(), "timed out") {
+		t.Errorf("Expected step to fail when deletion times out, got %v", results)
+	}
+}
+
+func TestWaitForJob(t *testing.T) {
+	for _, conditionType := range []batchv1.JobConditionType{batchv1.JobComplete, batchv1.JobFailed} {
+		job := batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+		clientset := fakeclientset.NewSimpleClientset()
+		src := runtime.Object(&job)
+		plan := generatePlan([]ObjectPair{{&src, nil}})
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			finished, _ := clientset.BatchV1().Jobs("default").Get("foo", metav1.GetOptions{})
+			finished.Status.Succeeded = 1
+			finished.Status.Conditions = []batchv1.JobCondition{{Type: conditionType, Status: v1.ConditionTrue}}
+			clientset.BatchV1().Jobs("default").UpdateStatus(finished)
+		}()
+
+		results := executePlan(plan, PlanConfig{kubeclient: clientset, execute: true, wait: true})
+
+		if conditionType == batchv1.JobComplete && hasFailedSteps(results) {
+			t.Errorf("Expected completed Job step to succeed, got %v", results[0].err)
+		} else if conditionType == batchv1.JobFailed && !hasFailedSteps(results) {
+			t.Errorf("Expected failed Job step to fail")
+		}
+	}
+}
+
+func TestCopyLogLines(t *testing.T) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+
+	err := copyLogLines("foo-1/job", strings.NewReader("starting\ndone\n"), &out, &lock)
+
+	if err != nil || out.String() != "[foo-1/job] starting\n[foo-1/job] done\n" {
+		t.Errorf("Incorrect prefixed log lines: %q", out.String())
+	}
+}
+
+func TestRunCronJob(t *testing.T) {
+	cronJobFoo, _ := getExampleCronJobs()
+	cronJobFoo.Name, cronJobFoo.Namespace, cronJobFoo.UID = "foo", "default", "abc"
+	cronJobFoo.Spec.JobTemplate.Labels = map[string]string{"app": "foo"}
+
+	job := getJobFromCronJob(&cronJobFoo)
+
+	if !strings.HasPrefix(job.Name, "foo-manual-") || len(job.Name) != len("foo-manual-")+5 || job.Namespace != "default" || job.Labels["app"] != "foo" {
+		t.Errorf("Incorrect Job metadata generated from CronJob: %v", job.ObjectMeta)
+	}
+
+	if len(job.OwnerReferences) != 1 || job.OwnerReferences[0].UID != "abc" || job.OwnerReferences[0].Kind != "CronJob" {
+		t.Errorf("Expected Job to be owned by CronJob")
+	}
+
+	clientset := fakeclientset.NewSimpleClientset(cronJobFoo.DeepCopy())
+	err := runCronJob("foo", "default", nil, PlanConfig{kubeclient: clientset, execute: true})
+
+	if err != nil {
+		t.Fatalf("Failed to run CronJob: %v", err)
+	}
+
+	//a second run in the same minute must not collide with the first one
+	err = runCronJob("foo", "default", nil, PlanConfig{kubeclient: clientset, execute: true})
+
+	if err != nil {
+		t.Fatalf("Failed to run CronJob a second time: %v", err)
+	}
+
+	jobs, _ := clientset.BatchV1().Jobs("default").List(metav1.ListOptions{})
+
+	if len(jobs.Items) != 2 || jobs.Items[0].Name == jobs.Items[1].Name || jobs.Items[0].Spec.Template.Spec.Containers[0].Image != "scratch" {
+		t.Errorf("Expected two Jobs created from the CronJob template")
+	}
+
+	err = runCronJob("bar", "default", nil, PlanConfig{kubeclient: clientset, execute: true})
+
+	if !errors.IsNotFound(err) {
+		t.Errorf("Expected missing CronJob error, got %v", err)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	suspended := true
+	cronJobs := []*batchv1beta1.CronJob{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default", Labels: map[string]string{"team": "a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "default", Labels: map[string]string{"team": "b"}}, Spec: batchv1beta1.CronJobSpec{Suspend: &suspended}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c", Namespace: "default"}},
+	}
+	clientset := fakeclientset.NewSimpleClientset(cronJobs[0], cronJobs[1], cronJobs[2])
+	config := PlanConfig{kubeclient: clientset, execute: true}
+	get := func(name string) *batchv1beta1.CronJob {
+		cronJob, _ := clientset.BatchV1beta1().CronJobs("default").Get(name, metav1.GetOptions{})
+		return cronJob
+	}
+
+	if err := suspendCronJobs("team", "", config); err != nil {
+		t.Fatalf("Failed to suspend CronJobs: %v", err)
+	}
+
+	if a := get("a"); a.Spec.Suspend == nil || !*a.Spec.Suspend || a.Annotations[suspendedAnnotation] != "false" {
+		t.Errorf("Expected CronJob a to be suspended and annotated")
+	}
+
+	if b := get("b"); b.Annotations[suspendedAnnotation] != "true" {
+		t.Errorf("Expected original state of CronJob b to be recorded")
+	}
+
+	if c := get("c"); c.Spec.Suspend != nil {
+		t.Errorf("Expected unlabeled CronJob c to be left alone")
+	}
+
+	var patches []string
+	clientset.PrependReactor("patch", "cronjobs", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(clienttesting.PatchAction).GetPatch()))
+		return false, nil, nil
+	})
+
+	if err := resumeCronJobs("team", "", config); err != nil {
+		t.Fatalf("Failed to resume CronJobs: %v", err)
+	}
+
+	if a := get("a"); a.Spec.Suspend == nil || *a.Spec.Suspend {
+		t.Errorf("Expected CronJob a to be resumed")
+	}
+
+	if len(patches) != 2 || !strings.Contains(patches[0], `"`+suspendedAnnotation+`":null`) {
+		t.Errorf("Expected suspended annotation to be removed, got %v", patches)
+	}
+
+	if b := get("b"); b.Spec.Suspend == nil || !*b.Spec.Suspend {
+		t.Errorf("Expected CronJob b to stay suspended")
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	from := time.Date(2026, time.October, 18, 10, 7, 30, 0, time.UTC)
+	cases := map[string][]string{
+		"*/15 * * * *":     {"2026-10-18 10:15", "2026-10-18 10:30"},
+		"@hourly":          {"2026-10-18 11:00", "2026-10-18 12:00"},
+		"0 0 * * mon-fri":  {"2026-10-19 00:00", "2026-10-20 00:00"},
+		"30 2 1 jan,jul *": {"2027-01-01 02:30", "2027-07-01 02:30"},
+		"0 12 13 * 5":      {"2026-10-23 12:00", "2026-10-30 12:00"},
+		"5/20 9-10 * * *":  {"2026-10-18 10:25", "2026-10-18 10:45"},
+		"@every 90m":       {"2026-10-18 11:37", "2026-10-18 13:07"},
+	}
+
+	for spec, expected := range cases {
+		schedule, err := parseCronSchedule(spec)
+
+		if err != nil {
+			t.Errorf("Failed to parse schedule %q: %v", spec, err)
+			continue
+		}
+
+		times := schedule.nextTimes(from, 2)
+
+		for i := range expected {
+			if i >= len(times) || times[i].Format("2006-01-02 15:04") != expected[i] {
+				t.Errorf("Incorrect fire times for %q: %v", spec, times)
+				break
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "@weekdays", "5-1 * * * *"} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("Expected schedule %q to be rejected", spec)
+		}
+	}
+
+	cronJobFoo, _ := getExampleCronJobs()
+	cronJobFoo.Spec.Schedule = "* * * * * *"
+
+	if err := validateObjects([]runtime.Object{&cronJobFoo}); err == nil {
+		t.Errorf("Expected invalid schedule to fail validation")
+	}
+}
+
+func TestScheduleRisks(t *testing.T) {
+	var deadline int64 = 7200
+	newCronJob := func(name string, schedule string, lock string) *batchv1beta1.CronJob {
+		return &batchv1beta1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"kubechange/lock": lock}},
+			Spec: batchv1beta1.CronJobSpec{
+				Schedule:          schedule,
+				ConcurrencyPolicy: batchv1beta1.ForbidConcurrent,
+			},
+		}
+	}
+
+	a := newCronJob("a", "0 * * * *", "db")
+	b := newCronJob("b", "0 3 * * *", "db")
+	c := newCronJob("c", "30 * * * *", "db")
+	d := newCronJob("d", "0 * * * *", "queue")
+	e := newCronJob("e", "*/30 * * * *", "")
+	e.Spec.ConcurrencyPolicy = batchv1beta1.AllowConcurrent
+	e.Spec.JobTemplate.Spec.ActiveDeadlineSeconds = &deadline
+
+	from := time.Date(2026, time.October, 18, 10, 0, 0, 0, time.UTC)
+	warnings := checkScheduleRisks([]runtime.Object{a, b, c, d, e}, "kubechange/lock", from)
+
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %v", warnings)
+	}
+
+	if !strings.Contains(warnings[0], `"a" and "b"`) || !strings.Contains(warnings[0], "2026-10-19 03:00") {
+		t.Errorf("Expected collision between a and b, got %s", warnings[0])
+	}
+
+	if !strings.Contains(warnings[1], `"e"`) || !strings.Contains(warnings[1], "longer than the 30m0s") {
+		t.Errorf("Expected overlap risk for e, got %s", warnings[1])
+	}
+}
+
+func TestParsingDocumentStream(t *testing.T) {
+	manifest := `# leading comment
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: first
+spec:
+  template:
+    spec:
+      containers:
+      - name: job
+        image: scratch
+        command: ["sh", "-c", "echo ---; echo done"]
+        args:
+        - |
+          ---
+          not a separator
+---
+# only a comment
+---
+
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: second
+`
+
+	objects, err := parseManifests(ManifestFile{path: "jobs.yml", content: manifest})
+
+	if err != nil || len(objects) != 2 {
+		t.Fatalf("Expected 2 objects, got %d: %v", len(objects), err)
+	}
+
+	first := objects[0].(*batchv1.Job)
+
+	if first.Name != "first" || first.Spec.Template.Spec.Containers[0].Args[0] != "---\nnot a separator\n" {
+		t.Errorf("Incorrect document content parsed")
+	}
+
+	_, err = parseManifests(ManifestFile{path: "broken.yml", content: "kind: Job\n---\napiVersion: batch/v1\nkind: [\n"})
+
+	if err == nil || !strings.Contains(err.Error(), "broken.yml: document 1 at line 1") {
+		t.Errorf("Expected error with file name and document index, got %v", err)
+	}
+
+	documents, _ := splitManifestDocuments(ManifestFile{path: "jobs.yml", content: manifest})
+
+	if len(documents) != 2 || documents[0].line != 3 || documents[1].line != 23 {
+		t.Errorf("Incorrect document positions: %v", documents)
+	}
+}
+
+func TestParsingJSONAndLists(t *testing.T) {
+	list := `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "first"}},
+    {"apiVersion": "batch/v1beta1", "kind": "CronJob", "metadata": {"name": "second"}, "spec": {"schedule": "* * * * *"}}
+  ]
+}
+{"apiVersion": "batch/v1", "kind": "JobList", "items": [{"metadata": {"name": "third"}}]}
+`
+
+	objects, err := parseManifests(ManifestFile{path: "list.json", content: list})
+
+	if err != nil || len(objects) != 3 {
+		t.Fatalf("Expected 3 objects, got %d: %v", len(objects), err)
+	}
+
+	if objects[0].(*batchv1.Job).Name != "first" || objects[1].(*batchv1beta1.CronJob).Name != "second" || objects[2].(*batchv1.Job).Name != "third" {
+		t.Errorf("Incorrect list items parsed")
+	}
+
+	documents, _ := splitManifestDocuments(ManifestFile{path: "list.json", content: list})
+
+	if len(documents) != 2 || documents[1].line != 9 {
+		t.Errorf("Incorrect JSON document positions: %v", documents)
+	}
+
+	yamlList := "apiVersion: batch/v1beta1\nkind: CronJobList\nitems:\n- metadata:\n    name: fourth\n  spec:\n    schedule: '@hourly'\n"
+	objects, err = parseManifests(ManifestFile{path: "list.yml", content: yamlList})
+
+	if err != nil || len(objects) != 1 || objects[0].(*batchv1beta1.CronJob).Name != "fourth" {
+		t.Errorf("Expected CronJobList to be expanded, got %v: %v", objects, err)
+	}
+
+	objects, err = parseManifests(ManifestFile{path: "array.json", content: `[{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "fifth"}}]`})
+
+	if err != nil || len(objects) != 1 {
+		t.Errorf("Expected JSON array to be expanded, got %v: %v", objects, err)
+	}
+}
+
+func TestInputPaths(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	job := "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: %s\n"
+	files := map[string]string{
+		"top.yml":                fmt.Sprintf(job, "top"),
+		"notes.txt":              "not a manifest",
+		"jobs/nested.yaml":       fmt.Sprintf(job, "nested"),
+		"jobs/deep/deeper.json":  `{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "deeper"}}`,
+		"jobs/skipped.yml":       fmt.Sprintf(job, "skipped"),
+		"generated/ignored.yml":  fmt.Sprintf(job, "ignored"),
+		".kubechangeignore":      "# ignored files\ngenerated/\nskipped.yml\n",
+		"jobs/deep/other/b.yaml": fmt.Sprintf(job, "other"),
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+
+	paths, err := expandInputPaths([]string{dir}, false)
+
+	if err != nil || len(paths) != 1 || paths[0] != filepath.Join(dir, "top.yml") {
+		t.Errorf("Expected only top level manifests, got %v: %v", paths, err)
+	}
+
+	paths, _ = expandInputPaths([]string{dir}, true)
+
+	if len(paths) != 4 {
+		t.Errorf("Expected 4 manifests without ignored files, got %v", paths)
+	}
+
+	paths, _ = expandInputPaths([]string{filepath.Join(dir, "jobs", "**", "*.yaml"), filepath.Join(dir, "top.yml"), "-"}, false)
+
+	if len(paths) != 4 || paths[0] != filepath.Join(dir, "jobs", "deep", "other", "b.yaml") || paths[3] != "-" {
+		t.Errorf("Incorrect glob expansion: %v", paths)
+	}
+
+	_, err = expandInputPaths([]string{filepath.Join(dir, "*.missing")}, false)
+
+	if err == nil {
+		t.Errorf("Expected an error for a pattern without matches")
+	}
+
+	objects, _ := readObjects([]string{filepath.Join(dir, "top.yml")}, InputConfig{})
+
+	if len(objects) != 1 || getObjectSource(objects[0]) != filepath.Join(dir, "top.yml")+":1" {
+		t.Errorf("Expected object source to be recorded, got %q", getObjectSource(objects[0]))
+	}
+
+	if source := getObjectSource(objects[0].DeepCopyObject()); source == "" {
+		t.Errorf("Expected object source to be kept by copies")
+	}
+
+	applied := getAppliedObject(objects[0])
+	appliedMetadata, _ := getObjectMetadata(applied)
+
+	if getObjectSource(applied) != "" || strings.Contains(appliedMetadata.GetAnnotations()[lastAppliedAnnotation], sourceAnnotation) {
+		t.Errorf("Expected object source not to be sent to the cluster")
+	}
+
+	if !matchGlob("a/**/b/*.yml", "a/b/c.yml") || matchGlob("a/*.yml", "a/b/c.yml") {
+		t.Errorf("Incorrect glob matching")
+	}
+
+	pattern := strings.Split("a/*/c/*.yml", "/")
+
+	if !matchGlobDirectory(pattern, []string{"a", "b"}) || matchGlobDirectory(pattern, []string{"a", "b", "c", "d"}) || matchGlobDirectory(pattern, []string{"a", "b", "d"}) {
+		t.Errorf("Incorrect glob directory matching")
+	}
+
+	if !matchGlobDirectory(strings.Split("a/**/*.yml", "/"), []string{"a", "b", "c", "d"}) {
+		t.Errorf("Expected ** to match any directory")
+	}
+
+	paths, _ = expandInputPaths([]string{filepath.Join(dir, "jobs", "*", "*.json")}, false)
+
+	if len(paths) != 1 || paths[0] != filepath.Join(dir, "jobs", "deep", "deeper.json") {
+		t.Errorf("Incorrect glob expansion without **: %v", paths)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.yml": `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+  namespace: staging
+  labels:
+    app: report
+spec:
+  schedule: "0 * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            image: registry:5000/report:v1
+            env:
+            - name: TARGET
+              value: staging
+          - name: sidecar
+            image: proxy
+`,
+		"production/overlay.yml": `namespace: production
+commonLabels:
+  env: production
+images:
+- name: registry:5000/report
+  newTag: v2
+patchesStrategicMerge:
+- schedule.yml
+patchesJson6902:
+- target:
+    kind: CronJob
+    name: report
+  patch: |
+    - op: replace
+      path: /spec/jobTemplate/spec/template/spec/containers/1/image
+      value: proxy:stable
+`,
+		"production/schedule.yml": `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+spec:
+  schedule: "30 2 * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            env:
+            - name: TARGET
+              value: production
+`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+
+	config := InputConfig{overlay: filepath.Join(dir, "production", "overlay.yml")}
+	objects, err := readObjects([]string{filepath.Join(dir, "base.yml")}, config)
+
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("Expected 1 object, got %d: %v", len(objects), err)
+	}
+
+	cronJob := objects[0].(*batchv1beta1.CronJob)
+	containers := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers
+
+	if cronJob.Namespace != "production" || cronJob.Spec.Schedule != "30 2 * * *" {
+		t.Errorf("Expected namespace and schedule to be overridden, got %s %q", cronJob.Namespace, cronJob.Spec.Schedule)
+	}
+
+	if cronJob.Labels["env"] != "production" || cronJob.Labels["app"] != "report" || cronJob.Spec.JobTemplate.Spec.Template.Labels["env"] != "production" {
+		t.Errorf("Expected common labels to be added, got %v", cronJob.Labels)
+	}
+
+	if len(containers) != 2 || containers[0].Image != "registry:5000/report:v2" || containers[0].Env[0].Value != "production" || containers[1].Image != "proxy:stable" {
+		t.Errorf("Incorrect patched containers: %v", containers)
+	}
+
+	if getObjectSource(cronJob) != filepath.Join(dir, "base.yml")+":1" {
+		t.Errorf("Expected the base source to be kept, got %q", getObjectSource(cronJob))
+	}
+
+	transformed, err := applyOverlay(objects, Overlay{Namespace: "staging", Images: []OverlayImage{{Name: "registry:5000/report", NewTag: "v3"}}})
+
+	if err != nil || transformed[0].(*batchv1beta1.CronJob).Namespace != "staging" || cronJob.Namespace != "production" || containers[0].Image != "registry:5000/report:v2" {
+		t.Errorf("Expected the overlay to transform copies of the objects: %v", err)
+	}
+
+	overlay := Overlay{PatchesStrategicMerge: []string{"missing.yml"}, path: config.overlay}
+
+	if _, err := applyOverlay(objects, overlay); err == nil || !strings.HasPrefix(err.Error(), config.overlay+": ") {
+		t.Errorf("Expected an error naming the overlay for a missing patch file, got %v", err)
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	valuesFile := filepath.Join(dir, "values.yml")
+	ioutil.WriteFile(valuesFile, []byte("image:\n  tag: v1\n  name: report\nreplicas: 1000000\n"), 0644)
+
+	values, err := loadValues([]string{"TARGET=staging", "IMAGE_TAG=env"}, []string{valuesFile}, []string{"image.tag=v2", "IMAGE_TAG=set"})
+
+	if err != nil {
+		t.Fatalf("Failed to load values: %v", err)
+	}
+
+	file := ManifestFile{path: "job.yml", content: "image: {{ .Values.image.name }}:{{.Values.image.tag}}\ntag: ${IMAGE_TAG}\ntarget: ${TARGET}\ncount: ${replicas}\nscript: echo $${HOME}\n"}
+	substituted, err := substituteVariables(file, values)
+	expected := "image: report:v2\ntag: set\ntarget: staging\ncount: 1000000\nscript: echo ${HOME}\n"
+
+	if err != nil || substituted.content != expected {
+		t.Errorf("Incorrect substitution %q: %v", substituted.content, err)
+	}
+
+	_, err = substituteVariables(ManifestFile{path: "job.yml", content: "a: ${MISSING}\nb: {{ .Values.image }}\n"}, values)
+
+	if err == nil || !strings.Contains(err.Error(), "${MISSING} at line 1") || !strings.Contains(err.Error(), "{{ .Values.image }} at line 2") {
+		t.Errorf("Expected unresolved variables error, got %v", err)
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: reports\nversion: 0.1.0\nappVersion: \"1.2\"\n",
+		"values.yaml": "schedule: \"0 * * * *\"\nimage:\n  repository: report\n  tag: latest\nenv:\n  TARGET: staging\nnightly:\n  enabled: false\n",
+		"templates/_helpers.tpl": `{{- define "reports.labels" -}}
+app: {{ .Chart.Name }}
+release: {{ .Release.Name }}
+{{- end -}}`,
+		"templates/cronjob.yaml": `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: {{ .Release.Name }}-report
+  namespace: {{ .Release.Namespace }}
+  labels:
+    {{- include "reports.labels" . | nindent 4 }}
+spec:
+  schedule: {{ .Values.schedule | quote }}
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: report
+            image: "{{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}"
+            args: [{{ .Files.Get "files/run.sh" | trim | quote }}, {{ len (.Files.Glob "files/*.sh") | quote }}]
+            env:
+            {{- range $name, $value := .Values.env }}
+            - name: {{ $name }}
+              value: {{ $value | quote }}
+            {{- end }}
+`,
+		"templates/nightly.yaml": `{{- if .Values.nightly.enabled }}
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: nightly
+{{- end }}
+`,
+		"templates/NOTES.txt": "Installed {{ .Release.Name }}",
+		"files/run.sh":        "./report --all\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+
+	valuesFile := filepath.Join(dir, "production.yaml")
+	ioutil.WriteFile(valuesFile, []byte("env:\n  TARGET: production\n"), 0644)
+
+	config := InputConfig{
+		chart:       dir,
+		release:     ChartRelease{Name: "prod", Namespace: "reports"},
+		valuesFiles: []string{valuesFile},
+		sets:        []string{"image.tag="},
+	}
+
+	objects, err := readObjects(nil, config)
+
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("Expected 1 object, got %d: %v", len(objects), err)
+	}
+
+	cronJob := objects[0].(*batchv1beta1.CronJob)
+	container := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0]
+
+	if cronJob.Name != "prod-report" || cronJob.Namespace != "reports" || cronJob.Labels["app"] != "reports" || cronJob.Labels["release"] != "prod" {
+		t.Errorf("Incorrect rendered metadata: %v", cronJob.ObjectMeta)
+	}
+
+	if cronJob.Spec.Schedule != "0 * * * *" || container.Image != "report:1.2" || container.Env[0].Value != "production" {
+		t.Errorf("Incorrect rendered spec: %q %q %v", cronJob.Spec.Schedule, container.Image, container.Env)
+	}
+
+	if !reflect.DeepEqual(container.Args, []string{"./report --all", "1"}) {
+		t.Errorf("Expected chart files to be rendered, got %v", container.Args)
+	}
+
+	if getObjectSource(cronJob) != filepath.Join(dir, "templates", "cronjob.yaml")+":1" {
+		t.Errorf("Expected the template to be the object source, got %q", getObjectSource(cronJob))
+	}
+
+	config.sets = []string{"nightly.enabled=true"}
+	objects, err = readObjects(nil, config)
+
+	if err != nil || len(objects) != 2 {
+		t.Errorf("Expected the nightly Job to be rendered, got %d: %v", len(objects), err)
+	}
+
+	config.sets = []string{"nightly.enabled=false"}
+	objects, err = readObjects(nil, config)
+
+	if err != nil || len(objects) != 1 {
+		t.Errorf("Expected the nightly Job to be disabled, got %d: %v", len(objects), err)
+	}
+
+	//parts of charts that are not rendered fail instead of producing an incomplete plan
+	unsupported := map[string]string{
+		"templates/version.yaml":   "kubeVersion: {{ .Capabilities.KubeVersion }}\n",
+		"charts/common/Chart.yaml": "name: common\nversion: 0.1.0\n",
+		"Chart.yaml":               "apiVersion: v2\nname: reports\nversion: 0.1.0\ndependencies:\n- name: common\n  version: 0.1.0\n",
+	}
+
+	for name, content := range unsupported {
+		path := filepath.Join(dir, name)
+		original, _ := ioutil.ReadFile(path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+
+		if _, err := readObjects(nil, config); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Errorf("Expected %s to be rejected, got %v", name, err)
+		}
+
+		if original != nil {
+			ioutil.WriteFile(path, original, 0644)
+		} else {
+			os.RemoveAll(filepath.Dir(path))
+		}
+	}
+}
+
+func TestReadGitRevision(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false", "-c", "tag.gpgsign=false"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, out)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	job := "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: %s\nspec:\n  template:\n    spec:\n      containers:\n      - name: job\n        image: %s\n" + strings.Repeat("# padding so that git stores a delta\n", 50)
+	write := func(name string, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	git("init", "-q")
+	write("jobs/report.yml", fmt.Sprintf(job, "report", "report:v1"))
+	write("jobs/generated/skip.yml", fmt.Sprintf(job, "skip", "skip"))
+	write(".kubechangeignore", "generated/\n")
+	git("add", "-A")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+
+	write("jobs/report.yml", fmt.Sprintf(job, "report", "report:v2"))
+	write("jobs/nested/cleanup.yml", fmt.Sprintf(job, "cleanup", "cleanup:v1"))
+	git("add", "-A")
+	git("commit", "-q", "-m", "second")
+	git("tag", "-a", "-m", "release", "v2")
+	second := git("rev-parse", "HEAD")
+
+	//the working tree is not read
+	write("jobs/report.yml", fmt.Sprintf(job, "report", "report:dirty"))
+
+	repoDir := dir
+	check := func(ref string, commit string, image string, count int) {
+		repo, err := openGitRepository(repoDir)
+
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+
+		resolved, err := repo.resolveCommit(ref)
+
+		if err != nil || resolved != commit {
+			t.Fatalf("Expected %s to resolve to %s, got %s: %v", ref, commit, resolved, err)
+		}
+
+		objects, err := readObjects([]string{"jobs"}, InputConfig{gitRepo: repoDir, gitCommit: resolved, recursive: true})
+
+		if err != nil || len(objects) != count {
+			t.Fatalf("Expected %d objects at %s, got %d: %v", count, ref, len(objects), err)
+		}
+
+		for _, o := range objects {
+			job := o.(*batchv1.Job)
+
+			if job.Annotations[gitCommitAnnotation] != commit {
+				t.Errorf("Expected %s to be annotated with commit %s", job.Name, commit)
+			}
+
+			if job.Name == "report" && job.Spec.Template.Spec.Containers[0].Image != image {
+				t.Errorf("Expected image %s at %s, got %s", image, ref, job.Spec.Template.Spec.Containers[0].Image)
+			}
+
+			if job.Name == "report" && getObjectSource(job) != commit[:7]+":jobs/report.yml:1" {
+				t.Errorf("Incorrect source %s", getObjectSource(job))
+			}
+		}
+	}
+
+	check("HEAD", second, "report:v2", 2)
+	check(first[:8], first, "report:v1", 1)
+
+	git("gc", "-q", "--aggressive")
+
+	if git("count-objects") != "0 objects, 0 kilobytes" {
+		t.Fatalf("Expected every object to be packed")
+	}
+	check("v2", second, "report:v2", 2)
+	check(strings.TrimPrefix(git("symbolic-ref", "HEAD"), "refs/heads/"), second, "report:v2", 2)
+	check(first, first, "report:v1", 1)
+
+	if _, err := readObjects([]string{"missing"}, InputConfig{gitRepo: dir, gitCommit: second}); err == nil {
+		t.Errorf("Expected an error for a missing path")
+	}
+
+	//linked worktrees have their own HEAD and share refs and objects with the main repository
+	worktree, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(worktree)
+	git("worktree", "add", "-q", "-b", "old", filepath.Join(worktree, "old"), first)
+	repoDir = filepath.Join(worktree, "old")
+	check("HEAD", first, "report:v1", 1)
+	check("old", first, "report:v1", 1)
+	check("v2", second, "report:v2", 2)
+
+	//shared clones read objects through alternates
+	clone, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(clone)
+	git("clone", "-q", "--shared", dir, clone)
+	repoDir = clone
+	check("HEAD", second, "report:v2", 2)
+	check("origin/old", first, "report:v1", 1)
+
+	//truncated tag and commit objects are reported instead of panicking
+	write("truncated", "object 1234\n")
+	tag := git("hash-object", "-t", "tag", "--literally", "-w", "truncated")
+	write("truncated", "tree 1234\n")
+	commit := git("hash-object", "-t", "commit", "--literally", "-w", "truncated")
+	repo, _ := openGitRepository(dir)
+
+	if _, err := repo.resolveCommit(tag); err == nil || !strings.Contains(err.Error(), "invalid object line") {
+		t.Errorf("Expected an error for a truncated tag, got %v", err)
+	}
+
+	if _, err := repo.readTree(commit); err == nil || !strings.Contains(err.Error(), "invalid tree line") {
+		t.Errorf("Expected an error for a truncated commit, got %v", err)
+	}
+
+	if _, _, err := repo.readLooseObject("1"); err == nil {
+		t.Errorf("Expected an error for an invalid object hash")
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	schemas := newBundledSchemaSet()
+
+	for _, file := range []string{"example-test-job.yml", "cluster-example-test-job.yml"} {
+		if _, err := readObjects([]string{file}, InputConfig{schemas: schemas}); err != nil {
+			t.Errorf("Expected %s to be valid: %v", file, err)
+		}
+	}
+
+	manifest := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: valid
+spec:
+  template:
+    spec:
+      containers:
+      - name: job
+        image: scratch
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: invalid
+spec:
+  schedule: "* * * * *"
+  suspend: "yes"
+  jobTemplate:
+    spec:
+      backoffLimit: 1.5
+      template:
+        spec:
+          containers:
+          - name: first
+            image: scratch
+          - image: scratch
+            env:
+            - name: TARGET
+              vaule: staging
+            resources:
+              limits:
+                cpu: 0.5
+`
+
+	err := validateManifestSchemas([]ManifestFile{{path: "jobs.yml", content: manifest}}, schemas)
+
+	if err == nil {
+		t.Fatalf("Expected schema validation errors")
+	}
+
+	expected := []string{
+		"jobs.yml:18: spec.suspend: expected boolean, got string",
+		"jobs.yml:21: spec.jobTemplate.spec.backoffLimit: expected integer, got number",
+		`jobs.yml:27: spec.jobTemplate.spec.template.spec.containers[1]: missing required field "name"`,
+		"jobs.yml:30: spec.jobTemplate.spec.template.spec.containers[1].env[0].vaule: unknown field",
+	}
+
+	for _, message := range expected {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q in:\n%s", message, err.Error())
+		}
+	}
+
+	if strings.Count(err.Error(), "\n") != len(expected) {
+		t.Errorf("Unexpected schema errors:\n%s", err.Error())
+	}
+
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	swagger := `{"definitions": {
+  "io.k8s.api.batch.v1.Job": {
+    "type": "object",
+    "properties": {"apiVersion": {"type": "string"}, "kind": {"type": "string"}, "metadata": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"}, "spec": {"type": "object", "required": ["template"], "properties": {"template": {"type": "object"}, "parallelism": {"type": "integer", "format": "int32"}}}},
+    "x-kubernetes-group-version-kind": [{"group": "batch", "kind": "Job", "version": "v1"}]
+  },
+  "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {
+    "type": "object",
+    "properties": {"name": {"type": "string"}, "labels": {"type": "object", "additionalProperties": {"type": "string"}}}
+  }
+}}`
+	swaggerFile := filepath.Join(dir, "swagger.json")
+	ioutil.WriteFile(swaggerFile, []byte(swagger), 0644)
+	clusterSchemas, err := loadSchemaFile(swaggerFile)
+
+	if err != nil {
+		t.Fatalf("Failed to load schema file: %v", err)
+	}
+
+	err = validateManifestSchemas([]ManifestFile{{path: "job.json", content: `{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "a", "labels": {"b": 1}}, "spec": {"parallelism": 2}}`}}, clusterSchemas)
+
+	if err == nil || !strings.Contains(err.Error(), "metadata.labels.b: expected string, got integer") || !strings.Contains(err.Error(), `spec: missing required field "template"`) {
+		t.Errorf("Expected errors from the cluster schema, got %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a.yml"), []byte("apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: a\nspec:\n  parallelism: two\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.yml"), []byte("apiVersion: batch/v1\nkind: Job\nmetadata:\n  nmae: b\n"), 0644)
+	_, err = readObjects([]string{filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml")}, InputConfig{schemas: newBundledSchemaSet()})
+
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "a.yml")+":6: spec.parallelism") || !strings.Contains(err.Error(), filepath.Join(dir, "b.yml")+":4: metadata.nmae: unknown field") {
+		t.Errorf("Expected the schema errors of every file, got %v", err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	manifest := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: careless
+spec:
+  template:
+    spec:
+      restartPolicy: Always
+      containers:
+      - name: job
+        image: report
+      - name: sidecar
+        image: proxy:latest
+        resources:
+          requests: {cpu: 100m, memory: 64Mi}
+          limits: {cpu: 100m, memory: 64Mi}
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: careful
+spec:
+  schedule: "@hourly"
+  concurrencyPolicy: Forbid
+  successfulJobsHistoryLimit: 1
+  failedJobsHistoryLimit: 1
+  jobTemplate:
+    spec:
+      backoffLimit: 2
+      activeDeadlineSeconds: 600
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: job
+            image: report@sha256:4b0c8e1d
+            resources:
+              requests: {cpu: 100m, memory: 64Mi}
+              limits: {cpu: 100m, memory: 64Mi}
+`
+
+	objects, err := parseManifests(ManifestFile{path: "jobs.yml", content: manifest})
+
+	if err != nil {
+		t.Fatalf("Failed to parse manifests: %v", err)
+	}
+
+	rules, _ := selectLintRules("", "")
+	findings := lintObjects(objects, rules)
+	found := make(map[string]int)
+
+	for _, finding := range findings {
+		if getObjectName(finding.object) != `Job "careless"` {
+			t.Errorf("Unexpected finding for %s: %v", getObjectName(finding.object), finding.messages)
+		}
+
+		found[finding.rule.name] = len(finding.messages)
+	}
+
+	expected := map[string]int{"image-tag": 2, "resources": 1, "restart-policy": 1, "backoff-limit": 1, "active-deadline": 1, "ttl-after-finished": 1}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected findings %v, got %v", expected, found)
+	}
+
+	if findings[0].rule.severity != "error" || findings[len(findings)-1].rule.severity != "info" {
+		t.Errorf("Expected findings sorted by severity")
+	}
+
+	for failOn, expectedCode := range map[string]int{"warning": 4, "error": 4, "none": 0} {
+		if code, _ := getLintExitCode(findings, failOn); code != expectedCode {
+			t.Errorf("Expected exit code %d with -fail-on %s, got %d", expectedCode, failOn, code)
+		}
+	}
+
+	rules, _ = selectLintRules("", "image-tag,restart-policy")
+
+	if code, _ := getLintExitCode(lintObjects(objects, rules), "warning"); code != 3 {
+		t.Errorf("Expected warnings to exit with 3, got %d", code)
+	}
+
+	if code, _ := getLintExitCode(lintObjects(objects, rules), "error"); code != 0 {
+		t.Errorf("Expected warnings to be ignored with -fail-on error, got %d", code)
+	}
+
+	rules, _ = selectLintRules("ttl-after-finished", "")
+
+	if code, _ := getLintExitCode(lintObjects(objects, rules), "warning"); len(rules) != 1 || code != 0 {
+		t.Errorf("Expected only info findings to exit with 0, got %d", code)
+	}
+
+	if _, err := selectLintRules("", "unknown"); err == nil {
+		t.Errorf("Expected an error for an unknown rule")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubechange")
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.yml")
+	ioutil.WriteFile(policyFile, []byte(`rules:
+- name: team-label
+  message: CronJobs in prod must set a team label
+  match:
+    kinds: [CronJob]
+    namespaces: [prod]
+  conditions:
+  - field: metadata.labels.team
+    operator: exists
+- name: registry
+  conditions:
+  - field: podSpec.containers[*].image
+    operator: matches
+    value: ^registry\.example\.com/
+- name: no-host-path
+  conditions:
+  - field: podSpec.volumes[*].hostPath
+    operator: notExists
+- name: no-prod-deletes
+  message: Deleting objects in prod is not allowed
+  match:
+    namespaces: [prod]
+    actions: [delete]
+waivers:
+- rule: registry
+  name: legacy
+  reason: migrating by the end of the quarter
+- rule: no-host-path
+  name: legacy
+  reason: expired waiver
+  expires: "2020-01-01"
+`), 0644)
+
+	policy, err := readPolicy(policyFile)
+
+	if err != nil {
+		t.Fatalf("Failed to read policy: %v", err)
+	}
+
+	manifest := `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+  namespace: prod
+  labels:
+    team: data
+spec:
+  schedule: "@hourly"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            image: registry.example.com/report:v1
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: legacy
+  namespace: prod
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: legacy
+            image: docker.io/legacy:v1
+          volumes:
+          - name: data
+            hostPath:
+              path: /data
+`
+
+	objects, err := parseManifests(ManifestFile{path: "jobs.yml", content: manifest})
+
+	if err != nil {
+		t.Fatalf("Failed to parse manifests: %v", err)
+	}
+
+	deleted := runtime.Object(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "prod"}})
+	plan := []Step{{pair: ObjectPair{src: &objects[0]}, action: "create"}, {pair: ObjectPair{dst: &deleted}, action: "delete"}}
+	violations := evaluatePolicy(policy, objects, plan, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	found := make(map[string]bool)
+
+	for _, violation := range violations {
+		metadata, _ := getObjectMetadata(violation.object)
+		found[fmt.Sprintf("%s/%s/%v", violation.rule.Name, metadata.GetName(), violation.waiver != nil)] = true
+	}
+
+	expected := map[string]bool{"team-label/legacy/false": true, "registry/legacy/true": true, "no-host-path/legacy/false": true, "no-prod-deletes/old/false": true}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected violations %v, got %v", expected, found)
+	}
+
+	if !reportPolicyViolations(violations, ioutil.Discard) {
+		t.Errorf("Expected unwaived violations to block execution")
+	}
+
+	policy.Rules = policy.Rules[1:2]
+
+	if reportPolicyViolations(evaluatePolicy(policy, objects, plan, time.Now()), ioutil.Discard) {
+		t.Errorf("Expected waived violations not to block execution")
+	}
+
+	ioutil.WriteFile(policyFile, []byte("rules:\n- name: bad\n  conditions:\n  - field: metadata.name\n    operator: startsWith\n"), 0644)
+
+	if _, err := readPolicy(policyFile); err == nil {
+		t.Errorf("Expected an error for an unknown operator")
+	}
+}
+
+func TestPlanOutput(t *testing.T) {
+	objects, err := parseManifests(ManifestFile{path: "jobs.yml", content: `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+  namespace: default
+spec:
+  schedule: "@hourly"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          restartPolicy: Never
+          containers:
+          - name: report
+            image: report:v2
+`})
+
+	if err != nil {
+		t.Fatalf("Failed to parse manifests: %v", err)
+	}
+
+	dst := objects[0].DeepCopyObject().(*batchv1beta1.CronJob)
+	dst.Spec.Schedule = "@daily"
+	dst.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image = "report:v1"
+	dst.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Args = []string{"--all"}
+	dst.Spec.JobTemplate.Spec.Template.Spec.DNSPolicy = v1.DNSClusterFirst
+	dst.ResourceVersion = "42"
+	dst.Annotations = map[string]string{lastAppliedAnnotation: `{"spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"report","args":["--all"]}]}}}}}}`}
+
+	var live runtime.Object = dst
+	plan := []Step{{pair: ObjectPair{src: &objects[0], dst: &live}, action: "update"}}
+	results := []StepResult{{step: plan[0], status: "succeeded"}}
+
+	expected := []FieldChange{
+		{Field: "spec.jobTemplate.spec.template.spec.containers[0].image", Old: "report:v1", New: "report:v2"},
+		{Field: "spec.schedule", Old: "@daily", New: "@hourly"},
+		{Field: "spec.jobTemplate.spec.template.spec.containers[0].args[0]", Old: "--all", New: nil},
+	}
+
+	output := getPlanOutput(results, PlanConfig{}, "abc123")
+
+	if output.Mode != "preview" || output.Commit != "abc123" || len(output.Steps) != 1 {
+		t.Fatalf("Unexpected plan output %+v", output)
+	}
+
+	step := output.Steps[0]
+
+	if step.Action != "update" || step.Kind != "CronJob" || step.Namespace != "default" || step.Name != "report" || step.Source != "jobs.yml:1" || step.Status != "planned" {
+		t.Errorf("Unexpected step output %+v", step)
+	}
+
+	if !reflect.DeepEqual(step.Changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, step.Changes)
+	}
+
+	var b bytes.Buffer
+
+	if err := writePlanOutput(&b, "json", getPlanOutput(results, PlanConfig{execute: true}, "")); err != nil {
+		t.Fatalf("Failed to write plan output: %v", err)
+	}
+
+	var decoded PlanOutput
+
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode plan output: %v", err)
+	}
+
+	if decoded.Mode != "execute" || decoded.Steps[0].Status != "succeeded" || len(decoded.Steps[0].Changes) != 3 {
+		t.Errorf("Unexpected decoded plan output %+v", decoded)
+	}
+
+	//with -o the plan and results are written to stderr instead of stdout
+	var messages bytes.Buffer
+	executePlan(plan, PlanConfig{kubeclient: fakeclientset.NewSimpleClientset(live), execute: true, out: &messages})
+
+	if !strings.Contains(messages.String(), "Updating CronJob \"report\"") || !strings.Contains(messages.String(), "Finished: 1 succeeded") {
+		t.Errorf("Expected plan messages to be written to the output writer, got %q", messages.String())
+	}
+}
+
+func TestMarkdownReport(t *testing.T) {
+	objects, err := parseManifests(ManifestFile{path: "jobs.yml", content: `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: report
+  namespace: default
+spec:
+  schedule: "@hourly"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: report
+            image: report:v1
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  namespace: default
+spec:
+  template:
+    spec:
+      containers:
+      - name: migrate
+        image: migrate:v2
+`})
+
+	if err != nil {
+		t.Fatalf("Failed to parse manifests: %v", err)
+	}
+
+	cronJob := objects[0].DeepCopyObject().(*batchv1beta1.CronJob)
+	cronJob.Spec.Schedule = "@daily"
+	job := objects[1].DeepCopyObject().(*batchv1.Job)
+	job.Spec.Template.Spec.Containers[0].Image = "migrate:v1"
+	var updated, replaced, deleted runtime.Object = cronJob, job, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "default"}}
+
+	plan := []Step{
+		{pair: ObjectPair{src: &objects[0], dst: &updated}, action: "update"},
+		{pair: ObjectPair{src: &objects[1], dst: &replaced}, action: "replace"},
+		{pair: ObjectPair{dst: &deleted}, action: "delete"},
+	}
+	results := make([]StepResult, 0, len(plan))
+
+	for _, step := range plan {
+		results = append(results, StepResult{step: step, status: "succeeded"})
+	}
+
+	report := renderMarkdownReport(results, PlanConfig{}, "abc123")
+
+	for _, expected := range []string{
+		"Preview of commit `abc123`",
+		"| 0 | 1 | 1 | 1 |",
+		"> - Deleting Job `default/old` removes it from the cluster",
+		"> - Replacing Job `default/migrate` deletes it",
+		"<summary>update CronJob `default/report` from `jobs.yml:1`</summary>",
+		"  spec.schedule:\n-   @daily\n+   @hourly\n",
+		"  spec.template.spec.containers[0].image:\n-   migrate:v1\n+   migrate:v2\n",
+		"- metadata:\n-   name: old\n",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected report to contain %q, got:\n%s", expected, report)
+		}
+	}
+
+	if strings.Count(report, "<details>") != 3 || strings.Contains(report, ", succeeded") {
+		t.Errorf("Expected one collapsed preview block per step, got:\n%s", report)
+	}
+
+	if report := renderMarkdownReport(nil, PlanConfig{execute: true}, ""); report != "## kubechange plan\n\nExecution: nothing to do.\n" {
+		t.Errorf("Unexpected report for an empty plan: %q", report)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+type PlanOutput struct {
+	Mode   string       `json:"mode"`
+	Commit string       `json:"commit,omitempty"`
+	Steps  []StepOutput `json:"steps"`
+}
+
+type StepOutput struct {
+	Action    string        `json:"action"`
+	Kind      string        `json:"kind"`
+	Namespace string        `json:"namespace"`
+	Name      string        `json:"name"`
+	Source    string        `json:"source,omitempty"`
+	Replaces  *ObjectOutput `json:"replaces,omitempty"`
+	Changes   []FieldChange `json:"changes,omitempty"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type ObjectOutput struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func isValidOutputFormat(format string) bool {
+	return format == "" || format == "json" || format == "yaml"
+}
+
+//returns the object as generic JSON, without server fields and the applied configuration annotation
+func getComparableDocument(object runtime.Object) (map[string]interface{}, string) {
+	object = stripServerFields(removeObjectSource(object))
+	metadata, _ := getObjectMetadata(object)
+	annotations := metadata.GetAnnotations()
+	applied := annotations[lastAppliedAnnotation]
+
+	if applied != "" {
+		delete(annotations, lastAppliedAnnotation)
+		metadata.SetAnnotations(annotations)
+	}
+
+	b, _ := getObjectJSON(object)
+	var document map[string]interface{}
+	json.Unmarshal(b, &document)
+	delete(document, "status")
+
+	return document, applied
+}
+
+func getDocumentValue(document interface{}, path []string) interface{} {
+	for _, element := range path {
+		var index int
+
+		if n, _ := fmt.Sscanf(element, "[%d]", &index); n == 1 {
+			items, ok := document.([]interface{})
+
+			if !ok || index >= len(items) {
+				return nil
+			}
+
+			document = items[index]
+		} else {
+			fields, ok := document.(map[string]interface{})
+
+			if !ok {
+				return nil
+			}
+
+			document = fields[element]
+		}
+	}
+
+	return document
+}
+
+//calls f with the path of every scalar, empty map and empty list in the document
+func walkDocumentLeaves(document interface{}, path []string, f func(path []string, value interface{})) {
+	switch v := document.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			f(path, v)
+		}
+
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			walkDocumentLeaves(v[key], append(append([]string{}, path...), key), f)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			f(path, v)
+		}
+
+		for i, item := range v {
+			walkDocumentLeaves(item, append(append([]string{}, path...), fmt.Sprintf("[%d]", i)), f)
+		}
+	default:
+		f(path, v)
+	}
+}
+
+//compares the fields set in the manifest with the cluster object, and reports fields removed
+//from the manifest since the last applied configuration, ignoring fields defaulted by the server
+func getFieldChanges(src runtime.Object, dst runtime.Object) []FieldChange {
+	srcKind := getObjectGroupVersionKind(src).Kind
+	dstKind := getObjectGroupVersionKind(dst).Kind
+
+	if srcKind != dstKind {
+		return []FieldChange{{Field: "kind", Old: dstKind, New: srcKind}}
+	}
+
+	srcDocument, _ := getComparableDocument(src)
+	dstDocument, applied := getComparableDocument(dst)
+	changes := make([]FieldChange, 0, 1)
+
+	walkDocumentLeaves(srcDocument, nil, func(path []string, value interface{}) {
+		old := getDocumentValue(dstDocument, path)
+
+		if !reflect.DeepEqual(old, value) {
+			changes = append(changes, FieldChange{Field: formatSchemaPath(path), Old: old, New: value})
+		}
+	})
+
+	var original map[string]interface{}
+
+	if json.Unmarshal([]byte(applied), &original) == nil {
+		walkDocumentLeaves(original, nil, func(path []string, value interface{}) {
+			old := getDocumentValue(dstDocument, path)
+
+			if getDocumentValue(srcDocument, path) == nil && old != nil {
+				changes = append(changes, FieldChange{Field: formatSchemaPath(path), Old: old, New: nil})
+			}
+		})
+	}
+
+	return changes
+}
+
+func getStepOutput(result StepResult, executed bool) StepOutput {
+	step := result.step
+	object := step.pair.src
+
+	if object == nil {
+		object = step.pair.dst
+	}
+
+	metadata, _ := getObjectMetadata(*object)
+	output := StepOutput{
+		Action:    step.action,
+		Kind:      getObjectGroupVersionKind(*object).Kind,
+		Namespace: metadata.GetNamespace(),
+		Name:      metadata.GetName(),
+		Source:    getObjectSource(*object),
+		Status:    "planned",
+	}
+
+	if step.pair.src != nil && step.pair.dst != nil {
+		output.Changes = getFieldChanges(*step.pair.src, *step.pair.dst)
+
+		if step.action == "replace" {
+			dstMetadata, _ := getObjectMetadata(*step.pair.dst)
+			output.Replaces = &ObjectOutput{Kind: getObjectGroupVersionKind(*step.pair.dst).Kind, Name: dstMetadata.GetName()}
+		}
+	}
+
+	if executed {
+		output.Status = result.status
+	}
+
+	if result.err != nil {
+		output.Error = result.err.Error()
+	}
+
+	return output
+}
+
+func getPlanOutput(results []StepResult, config PlanConfig, commit string) PlanOutput {
+	output := PlanOutput{Mode: "preview", Commit: commit, Steps: make([]StepOutput, 0, len(results))}
+
+	if config.dryRun {
+		output.Mode = "server-dry-run"
+	} else if config.execute {
+		output.Mode = "execute"
+	}
+
+	for _, result := range results {
+		output.Steps = append(output.Steps, getStepOutput(result, config.execute || config.dryRun))
+	}
+
+	return output
+}
+
+func writePlanOutput(out io.Writer, format string, output PlanOutput) error {
+	var b []byte
+	var err error
+
+	if format == "yaml" {
+		b, err = yaml.Marshal(output)
+	} else {
+		b, err = json.MarshalIndent(output, "", "  ")
+		b = append(b, '\n')
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(b)
+	return err
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+//a subset of kustomization.yaml, applied to the parsed base manifests
+type Overlay struct {
+	Namespace             string             `json:"namespace,omitempty"`
+	CommonLabels          map[string]string  `json:"commonLabels,omitempty"`
+	Images                []OverlayImage     `json:"images,omitempty"`
+	PatchesStrategicMerge []string           `json:"patchesStrategicMerge,omitempty"`
+	PatchesJSON6902       []OverlayJSONPatch `json:"patchesJson6902,omitempty"`
+	path                  string
+}
+
+type OverlayImage struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName,omitempty"`
+	NewTag  string `json:"newTag,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+type OverlayJSONPatch struct {
+	Target OverlayTarget `json:"target"`
+	Path   string        `json:"path,omitempty"`
+	Patch  string        `json:"patch,omitempty"`
+}
+
+type OverlayTarget struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func readOverlay(path string) (Overlay, error) {
+	overlay := Overlay{path: path}
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return overlay, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, &overlay); err != nil {
+		return overlay, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return overlay, nil
+}
+
+func matchesOverlayTarget(object runtime.Object, target OverlayTarget) bool {
+	metadata, _ := getObjectMetadata(object)
+
+	return getObjectGroupVersionKind(object).Kind == target.Kind && metadata.GetName() == target.Name &&
+		(target.Namespace == "" || metadata.GetNamespace() == target.Namespace)
+}
+
+func findOverlayTarget(objects []runtime.Object, target OverlayTarget) (int, error) {
+	for i, o := range objects {
+		if matchesOverlayTarget(o, target) {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("no object matches patch target %s %q", target.Kind, target.Name)
+}
+
+func newObjectOfType(object runtime.Object) (runtime.Object, error) {
+	switch object.(type) {
+	case *batchv1.Job:
+		return &batchv1.Job{}, nil
+	case *batchv1beta1.CronJob:
+		return &batchv1beta1.CronJob{}, nil
+	}
+
+	return nil, unsupportedObjectError(object)
+}
+
+//decodes the patched JSON into a new object
+func replacePatchedObject(objects []runtime.Object, i int, patched []byte) error {
+	object, err := newObjectOfType(objects[i])
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(patched, object); err != nil {
+		return err
+	}
+
+	objects[i] = object
+
+	return nil
+}
+
+func applyStrategicMergeDocument(objects []runtime.Object, document ManifestDocument) error {
+	patch, _, err := scheme.Codecs.UniversalDeserializer().Decode(document.data, nil, nil)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.YAMLToJSON(document.data)
+
+	if err != nil {
+		return err
+	}
+
+	metadata, _ := getObjectMetadata(patch)
+	target := OverlayTarget{Kind: getObjectGroupVersionKind(patch).Kind, Name: metadata.GetName(), Namespace: metadata.GetNamespace()}
+	i, err := findOverlayTarget(objects, target)
+
+	if err != nil {
+		return err
+	}
+
+	original, err := getObjectJSON(objects[i])
+
+	if err != nil {
+		return err
+	}
+
+	patchMeta, err := getPatchMeta(objects[i])
+
+	if err != nil {
+		return err
+	}
+
+	patched, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(original, data, patchMeta)
+
+	if err != nil {
+		return err
+	}
+
+	return replacePatchedObject(objects, i, patched)
+}
+
+func applyJSONPatch(objects []runtime.Object, patch OverlayJSONPatch, data []byte) error {
+	i, err := findOverlayTarget(objects, patch.Target)
+
+	if err != nil {
+		return err
+	}
+
+	data, err = yaml.YAMLToJSON(data)
+
+	if err != nil {
+		return err
+	}
+
+	operations, err := jsonpatch.DecodePatch(data)
+
+	if err != nil {
+		return err
+	}
+
+	original, err := getObjectJSON(objects[i])
+
+	if err != nil {
+		return err
+	}
+
+	patched, err := operations.Apply(original)
+
+	if err != nil {
+		return err
+	}
+
+	return replacePatchedObject(objects, i, patched)
+}
+
+func getObjectPodTemplate(object runtime.Object) (*v1.PodTemplateSpec, *batchv1beta1.JobTemplateSpec) {
+	switch t := object.(type) {
+	case *batchv1.Job:
+		return &t.Spec.Template, nil
+	case *batchv1beta1.CronJob:
+		return &t.Spec.JobTemplate.Spec.Template, &t.Spec.JobTemplate
+	}
+
+	return nil, nil
+}
+
+func addLabels(labels map[string]string, common map[string]string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+
+	for k, v := range common {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+//splits an image reference into its name and its tag or digest suffix
+func splitImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], image[i:]
+	}
+
+	//a colon before the last slash belongs to a registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i:]
+	}
+
+	return image, ""
+}
+
+func overrideImage(image string, images []OverlayImage) string {
+	name, suffix := splitImage(image)
+
+	for _, override := range images {
+		if override.Name != name {
+			continue
+		}
+
+		if override.NewName != "" {
+			name = override.NewName
+		}
+
+		if override.Digest != "" {
+			suffix = "@" + override.Digest
+		} else if override.NewTag != "" {
+			suffix = ":" + override.NewTag
+		}
+
+		return name + suffix
+	}
+
+	return image
+}
+
+func transformObject(object runtime.Object, overlay Overlay) {
+	metadata, _ := getObjectMetadata(object)
+
+	if overlay.Namespace != "" {
+		metadata.SetNamespace(overlay.Namespace)
+	}
+
+	if len(overlay.CommonLabels) > 0 {
+		metadata.SetLabels(addLabels(metadata.GetLabels(), overlay.CommonLabels))
+	}
+
+	template, jobTemplate := getObjectPodTemplate(object)
+
+	if template == nil {
+		return
+	}
+
+	if len(overlay.CommonLabels) > 0 {
+		template.Labels = addLabels(template.Labels, overlay.CommonLabels)
+
+		if jobTemplate != nil {
+			jobTemplate.Labels = addLabels(jobTemplate.Labels, overlay.CommonLabels)
+		}
+	}
+
+	for _, containers := range [][]v1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for i := range containers {
+			containers[i].Image = overrideImage(containers[i].Image, overlay.Images)
+		}
+	}
+}
+
+//patches are matched against the base objects, then namespace, labels and images are overridden
+func applyOverlay(objects []runtime.Object, overlay Overlay) ([]runtime.Object, error) {
+	objects = append([]runtime.Object{}, objects...)
+	dir := filepath.Dir(overlay.path)
+
+	for _, path := range overlay.PatchesStrategicMerge {
+		file, err := readInputFile(filepath.Join(dir, path))
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", overlay.path, err.Error())
+		}
+
+		documents, err := splitManifestDocuments(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, document := range documents {
+			if err := applyStrategicMergeDocument(objects, document); err != nil {
+				return nil, fmt.Errorf("%s: document %d at line %d: %s", document.path, document.index, document.line, err.Error())
+			}
+		}
+	}
+
+	for _, patch := range overlay.PatchesJSON6902 {
+		data := []byte(patch.Patch)
+		source := "inline patch"
+
+		if patch.Path != "" {
+			source = filepath.Join(dir, patch.Path)
+			b, err := ioutil.ReadFile(source)
+
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", overlay.path, err.Error())
+			}
+
+			data = b
+		}
+
+		if err := applyJSONPatch(objects, patch, data); err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err.Error())
+		}
+	}
+
+	//objects that were not patched are still the caller's
+	for i, o := range objects {
+		objects[i] = o.DeepCopyObject()
+		transformObject(objects[i], overlay)
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const lastAppliedAnnotation = "kubechange/last-applied-configuration"
+
+var conflictBackoff = wait.Backoff{Duration: 500 * time.Millisecond, Factor: 2, Jitter: 0.1, Steps: 5}
+
+func getObjectJSON(object runtime.Object) ([]byte, error) {
+	object = object.DeepCopyObject()
+	object.GetObjectKind().SetGroupVersionKind(schema.GroupVersionKind{})
+
+	return json.Marshal(object)
+}
+
+//returns a copy of a local object without server fields, annotated with its own configuration
+//so that fields removed from the manifest can be removed from the cluster object on the next update
+func getAppliedObject(object runtime.Object) runtime.Object {
+	object = stripServerFields(removeObjectSource(object))
+	metadata, _ := getObjectMetadata(object)
+	annotations := metadata.GetAnnotations()
+	delete(annotations, lastAppliedAnnotation)
+	metadata.SetAnnotations(annotations)
+
+	b, err := getObjectJSON(object)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	annotations[lastAppliedAnnotation] = string(b)
+	metadata.SetAnnotations(annotations)
+
+	return object
+}
+
+func getPatchMeta(object runtime.Object) (strategicpatch.LookupPatchMeta, error) {
+	switch object.(type) {
+	case *batchv1.Job:
+		return strategicpatch.NewPatchMetaFromStruct(&batchv1.Job{})
+	case *batchv1beta1.CronJob:
+		return strategicpatch.NewPatchMetaFromStruct(&batchv1beta1.CronJob{})
+	}
+
+	return nil, unsupportedObjectError(object)
+}
+
+//computes a three-way strategic merge patch between the last applied configuration, the local object and the live object
+func createObjectPatch(src runtime.Object, dst runtime.Object) ([]byte, error) {
+	desired := getAppliedObject(src)
+	desiredMetadata, _ := getObjectMetadata(desired)
+	dstMetadata, _ := getObjectMetadata(dst)
+
+	modified, err := getObjectJSON(desired)
+
+	if err != nil {
+		return nil, err
+	}
+
+	//without a previously applied configuration nothing is removed from the live object
+	original := []byte(desiredMetadata.GetAnnotations()[lastAppliedAnnotation])
+
+	if lastApplied, ok := dstMetadata.GetAnnotations()[lastAppliedAnnotation]; ok {
+		original = []byte(lastApplied)
+	}
+
+	current, err := getObjectJSON(dst)
+
+	if err != nil {
+		return nil, err
+	}
+
+	patchMeta, err := getPatchMeta(src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, patchMeta, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return setPatchResourceVersion(patch, dstMetadata.GetResourceVersion())
+}
+
+//the API server rejects a patch with a conflict if its resourceVersion is no longer the live one
+func setPatchResourceVersion(patch []byte, resourceVersion string) ([]byte, error) {
+	if resourceVersion == "" {
+		return patch, nil
+	}
+
+	var patchMap map[string]interface{}
+	err := json.Unmarshal(patch, &patchMap)
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, ok := patchMap["metadata"].(map[string]interface{})
+
+	if !ok {
+		metadata = make(map[string]interface{})
+		patchMap["metadata"] = metadata
+	}
+
+	metadata["resourceVersion"] = resourceVersion
+
+	return json.Marshal(patchMap)
+}
+
+func isSameFields(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	aFields := make(map[string]bool)
+
+	for _, field := range a {
+		aFields[field] = true
+	}
+
+	for _, field := range b {
+		if !aFields[field] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//on conflicts the live object is fetched again and the patch is recomputed, as long as
+//the remaining changes, with their old and new values, are the ones that were in the plan
+func updateObjectWithRetries(step Step, config PlanConfig) error {
+	src := *step.pair.src
+	dst := *step.pair.dst
+	changes := getFieldChanges(src, dst)
+	var lastErr error
+
+	err := wait.ExponentialBackoff(conflictBackoff, func() (bool, error) {
+		lastErr = patchObject(src, dst, config)
+
+		if !errors.IsConflict(lastErr) {
+			return true, lastErr
+		}
+
+		fmt.Fprintln(config.output(), "Conflict updating "+getObjectName(dst)+", retrying")
+
+		live, err := getObject(dst, config)
+
+		if err != nil {
+			return false, err
+		}
+
+		fields := deepCompareObject(src, live)
+
+		if len(fields) == 0 {
+			lastErr = nil
+			return true, nil
+		}
+
+		if !isSameFields(fields, step.fields) || hasImmutableFieldChanges(src, live) {
+			return false, fmt.Errorf("%s was changed since the plan was generated, changed fields are now %s instead of %s",
+				getObjectName(dst), strings.Join(fields, ", "), strings.Join(step.fields, ", "))
+		}
+
+		if !reflect.DeepEqual(getFieldChanges(src, live), changes) {
+			return false, fmt.Errorf("%s was changed since the plan was generated, the values of %s are no longer the planned ones",
+				getObjectName(dst), strings.Join(fields, ", "))
+		}
+
+		dst = live
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+
+	return err
+}
+
+func patchObject(src runtime.Object, dst runtime.Object, config PlanConfig) error {
+	patch, err := createObjectPatch(src, dst)
+
+	if err != nil {
+		return err
+	}
+
+	return applyPatch(dst, types.StrategicMergePatchType, patch, config)
+}
+
+func applyPatch(object runtime.Object, patchType types.PatchType, patch []byte, config PlanConfig) error {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+	namespace := metadata.GetNamespace()
+
+	return config.retry.do(func() error {
+		var err error
+
+		switch object.(type) {
+		case *batchv1.Job:
+			if config.dryRun {
+				err = clientset.BatchV1().RESTClient().Patch(patchType).Namespace(namespace).Resource("jobs").Name(metadata.GetName()).Param("dryRun", metav1.DryRunAll).Body(patch).Do().Error()
+			} else {
+				_, err = clientset.BatchV1().Jobs(namespace).Patch(metadata.GetName(), patchType, patch)
+			}
+		case *batchv1beta1.CronJob:
+			if config.dryRun {
+				err = clientset.BatchV1beta1().RESTClient().Patch(patchType).Namespace(namespace).Resource("cronjobs").Name(metadata.GetName()).Param("dryRun", metav1.DryRunAll).Body(patch).Do().Error()
+			} else {
+				_, err = clientset.BatchV1beta1().CronJobs(namespace).Patch(metadata.GetName(), patchType, patch)
+			}
+		default:
+			err = unsupportedObjectError(object)
+		}
+
+		return err
+	})
+}
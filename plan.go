@@ -2,16 +2,18 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
 	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/client-go/kubernetes"
 )
 
 //todo: filter out Jobs that are children of CronJobs
@@ -74,25 +76,281 @@ func getObjectNamespaces(objects []runtime.Object) []string {
 	return namespaces
 }
 
-func waitForObjectDeletion(object runtime.Object, clientset kubernetes.Interface) error {
-	return wait.PollImmediate(time.Second, time.Second*60, func() (bool, error) {
+//counts the objects that foreground deletion still has to remove before the object itself is gone
+func countObjectDependents(object runtime.Object, config PlanConfig) (int, string, error) {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+
+	switch object.(type) {
+	case *batchv1.Job:
+		var pods *v1.PodList
+		err := config.retry.do(func() error {
+			var err error
+			pods, err = clientset.CoreV1().Pods(metadata.GetNamespace()).List(metav1.ListOptions{
+				LabelSelector: "controller-uid=" + string(metadata.GetUID()),
+			})
+			return err
+		})
+
+		if err != nil {
+			return 0, "", err
+		}
+
+		return len(pods.Items), "pods", nil
+	case *batchv1beta1.CronJob:
+		var jobs *batchv1.JobList
+		err := config.retry.do(func() error {
+			var err error
+			jobs, err = clientset.BatchV1().Jobs(metadata.GetNamespace()).List(metav1.ListOptions{})
+			return err
+		})
+
+		if err != nil {
+			return 0, "", err
+		}
+
+		count := 0
+
+		for _, job := range jobs.Items {
+			for _, owner := range job.OwnerReferences {
+				if owner.UID == metadata.GetUID() {
+					count++
+				}
+			}
+		}
+
+		return count, "Jobs", nil
+	}
+
+	return 0, "", unsupportedObjectError(object)
+}
+
+func waitForObjectDeletion(object runtime.Object, config PlanConfig) error {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+	timeout := config.deleteTimeout
+	lastDependents := -1
+
+	if timeout == 0 {
+		timeout = time.Second * 60
+	}
+
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		var live runtime.Object
 		var err error
-		switch t := object.(type) {
+
+		switch object.(type) {
 		case *batchv1.Job:
-			metadata, _ := meta.Accessor(t)
-			_, err = clientset.BatchV1().Jobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
+			live, err = clientset.BatchV1().Jobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
 		case *batchv1beta1.CronJob:
-			metadata, _ := meta.Accessor(t)
-			_, err = clientset.BatchV1beta1().CronJobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
+			live, err = clientset.BatchV1beta1().CronJobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
 		}
 
-		if err == nil {
-			return false, nil
-		} else if errors.IsNotFound(err) {
+		if errors.IsNotFound(err) {
 			return true, nil
-		} else {
+		} else if err != nil && !isRetriableError(err) {
 			return false, err
+		} else if err != nil {
+			return false, nil
+		}
+
+		dependents, kind, err := countObjectDependents(live, config)
+
+		if err == nil && dependents != lastDependents {
+			fmt.Fprintf(config.output(), "Waiting for %s to be deleted, %d %s remaining\n", getObjectName(object), dependents, kind)
+			lastDependents = dependents
+		}
+
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out after %s waiting for %s to be deleted", timeout, getObjectName(object))
+	}
+
+	return err
+}
+
+func getObjectName(o runtime.Object) string {
+	metadata, _ := getObjectMetadata(o)
+	return getObjectGroupVersionKind(o).Kind + ` "` + metadata.GetName() + `"`
+}
+
+func unsupportedObjectError(object runtime.Object) error {
+	return fmt.Errorf("unsupported object %T", object)
+}
+
+func getObject(object runtime.Object, config PlanConfig) (runtime.Object, error) {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+	var live runtime.Object
+
+	err := config.retry.do(func() error {
+		var err error
+
+		switch object.(type) {
+		case *batchv1.Job:
+			live, err = clientset.BatchV1().Jobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
+		case *batchv1beta1.CronJob:
+			live, err = clientset.BatchV1beta1().CronJobs(metadata.GetNamespace()).Get(metadata.GetName(), metav1.GetOptions{})
+		default:
+			err = unsupportedObjectError(object)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return live, nil
+}
+
+//lists the supported objects in a namespace, or in all namespaces if it is empty
+func listObjects(namespace string, config PlanConfig) ([]runtime.Object, error) {
+	clientset := config.kubeclient
+	objects := make([]runtime.Object, 0, 1)
+
+	var jobs *batchv1.JobList
+	err := config.retry.do(func() error {
+		var err error
+		jobs, err = clientset.BatchV1().Jobs(namespace).List(metav1.ListOptions{})
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range jobs.Items {
+		objects = append(objects, &jobs.Items[i])
+	}
+
+	var cronjobs *batchv1beta1.CronJobList
+	err = config.retry.do(func() error {
+		var err error
+		cronjobs, err = clientset.BatchV1beta1().CronJobs(namespace).List(metav1.ListOptions{})
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cronjobs.Items {
+		objects = append(objects, &cronjobs.Items[i])
+	}
+
+	return objects, nil
+}
+
+//in dry run mode the request goes through admission and validation but is not persisted,
+//otherwise a create that timed out may have been persisted, so an object found by a retry
+//is accepted when it has the configuration that was sent
+func createObject(object runtime.Object, config PlanConfig) error {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+	namespace := metadata.GetNamespace()
+	retried := false
+
+	return config.retry.do(func() error {
+		var err error
+
+		switch t := object.(type) {
+		case *batchv1.Job:
+			if config.dryRun {
+				err = clientset.BatchV1().RESTClient().Post().Namespace(namespace).Resource("jobs").Param("dryRun", metav1.DryRunAll).Body(t).Do().Error()
+			} else {
+				_, err = clientset.BatchV1().Jobs(namespace).Create(t)
+			}
+		case *batchv1beta1.CronJob:
+			if config.dryRun {
+				err = clientset.BatchV1beta1().RESTClient().Post().Namespace(namespace).Resource("cronjobs").Param("dryRun", metav1.DryRunAll).Body(t).Do().Error()
+			} else {
+				_, err = clientset.BatchV1beta1().CronJobs(namespace).Create(t)
+			}
+		default:
+			err = unsupportedObjectError(object)
+		}
+
+		if retried && !config.dryRun && errors.IsAlreadyExists(err) && isCreatedObject(object, config) {
+			err = nil
+		}
+
+		retried = true
+		return err
+	})
+}
+
+func isCreatedObject(object runtime.Object, config PlanConfig) bool {
+	live, err := getObject(object, config)
+
+	if err != nil {
+		return false
+	}
+
+	metadata, _ := getObjectMetadata(object)
+	liveMetadata, _ := getObjectMetadata(live)
+
+	if applied := metadata.GetAnnotations()[lastAppliedAnnotation]; applied != "" {
+		return liveMetadata.GetAnnotations()[lastAppliedAnnotation] == applied
+	}
+
+	return len(deepCompareObject(object, live)) == 0
+}
+
+func updateObject(object runtime.Object, config PlanConfig) error {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+
+	return config.retry.do(func() error {
+		var err error
+
+		switch t := object.(type) {
+		case *batchv1.Job:
+			_, err = clientset.BatchV1().Jobs(metadata.GetNamespace()).Update(t)
+		case *batchv1beta1.CronJob:
+			_, err = clientset.BatchV1beta1().CronJobs(metadata.GetNamespace()).Update(t)
+		default:
+			err = unsupportedObjectError(object)
+		}
+
+		return err
+	})
+}
+
+func deleteObject(object runtime.Object, config PlanConfig) error {
+	clientset := config.kubeclient
+	metadata, _ := getObjectMetadata(object)
+	propagationPolicy := metav1.DeletePropagationForeground
+	options := &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy}
+
+	if config.dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+
+	retried := false
+
+	return config.retry.do(func() error {
+		var err error
+
+		switch object.(type) {
+		case *batchv1.Job:
+			err = clientset.BatchV1().Jobs(metadata.GetNamespace()).Delete(metadata.GetName(), options)
+		case *batchv1beta1.CronJob:
+			err = clientset.BatchV1beta1().CronJobs(metadata.GetNamespace()).Delete(metadata.GetName(), options)
+		default:
+			err = unsupportedObjectError(object)
+		}
+
+		//an earlier attempt may have deleted the object before its response was lost
+		if retried && !config.dryRun && errors.IsNotFound(err) {
+			err = nil
 		}
+
+		retried = true
+		return err
 	})
 }
 
@@ -101,197 +359,267 @@ func generatePlan(pairs []ObjectPair) []Step {
 
 	for _, pair := range pairs {
 		var action string
+		var fields []string
 
 		if pair.dst == nil {
 			action = "create"
 		} else if pair.src == nil {
 			action = "delete"
 		} else if pair.dst != nil {
-			pairDiffFields := deepCompareObject(*pair.src, *pair.dst)
-			if len(pairDiffFields) > 0 {
+			fields = deepCompareObject(*pair.src, *pair.dst)
+			if len(fields) > 0 {
 				action = "update"
+
+				if hasImmutableFieldChanges(*pair.src, *pair.dst) {
+					action = "replace"
+				}
 			}
 		}
 
 		if action != "" {
-			plan = append(plan, Step{pair: pair, action: action})
+			plan = append(plan, Step{pair: pair, action: action, fields: fields})
 		}
 	}
 
 	return plan
 }
 
+func waitForCreatedJob(object runtime.Object, config PlanConfig) error {
+	job, ok := object.(*batchv1.Job)
+
+	if !ok || !(config.wait || config.logs) || config.dryRun {
+		return nil
+	}
+
+	return waitForJobCompletion(job, config)
+}
+
 //todo: figure out how to test this with a mock clientset (kubernetes.Interface?)
 //use something like https://github.com/GoogleCloudPlatform/skaffold/blob/21116842e65c0c7ace293352fad2b1f4adb5c9b2/pkg/skaffold/kubernetes/client.go
-func executePlan(plan []Step, config PlanConfig) {
-	clientset := config.kubeclient
-	execute := config.execute
-	for _, step := range plan {
-		if step.action == "create" {
-			src := *step.pair.src
-			srcMetadata, _ := getObjectMetadata(src)
-			switch srcType := src.(type) {
-			case *batchv1beta1.CronJob:
-				fmt.Println(`Creating CronJob "` + srcMetadata.GetName() + `"`)
-
-				if !execute {
-					break
-				}
+func executeStep(step Step, config PlanConfig) error {
+	apply := config.execute || config.dryRun
 
-				_, err := clientset.BatchV1beta1().CronJobs(srcMetadata.GetNamespace()).Create(src.(*batchv1beta1.CronJob))
+	if step.action == "create" {
+		src := *step.pair.src
+		fmt.Fprintln(config.output(), "Creating "+getObjectName(src)+describeObjectSource(src))
+		printSchedulePreview(step, config)
 
-				if err != nil {
-					panic(err)
-				}
+		if !apply {
+			return nil
+		}
 
-			case *batchv1.Job:
-				fmt.Println(`Creating Job "` + srcMetadata.GetName() + `"`)
+		err := createObject(getAppliedObject(src), config)
 
-				if !execute {
-					break
-				}
+		if err != nil {
+			return err
+		}
 
-				_, err := clientset.BatchV1().Jobs(srcMetadata.GetNamespace()).Create(src.(*batchv1.Job))
+		return waitForCreatedJob(src, config)
+	} else if step.action == "delete" {
+		dst := *step.pair.dst
+		fmt.Fprintln(config.output(), "Deleting "+getObjectName(dst))
 
-				if err != nil {
-					panic(err)
-				}
-			default:
-				_ = srcType
-			}
-		} else if step.action == "delete" {
-			dst := *step.pair.dst
-			dstMetadata, _ := getObjectMetadata(dst)
-			propagationPolicy := metav1.DeletePropagationForeground
+		if !apply {
+			return nil
+		}
 
-			switch dstType := dst.(type) {
-			case *batchv1.Job:
-				fmt.Println(`Deleting Job "` + dstMetadata.GetName() + `"`)
+		err := deleteObject(dst, config)
 
-				if !execute {
-					break
-				}
+		if err != nil || config.dryRun {
+			return err
+		}
 
-				err := clientset.BatchV1().Jobs(dstMetadata.GetNamespace()).Delete(dstMetadata.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+		return waitForObjectDeletion(dst, config)
+	} else if step.action == "update" {
+		dst := *step.pair.dst
+		dstMetadata, _ := getObjectMetadata(dst)
+		fmt.Fprintln(config.output(), "Updating "+getObjectName(dst)+" in "+dstMetadata.GetNamespace()+" namespace"+describeObjectSource(*step.pair.src))
+		printSchedulePreview(step, config)
 
-				if err != nil {
-					panic(err)
-				}
+		if !apply {
+			return nil
+		}
 
-				waitForObjectDeletion(dst, clientset)
-			case *batchv1beta1.CronJob:
-				fmt.Println(`Deleting CronJob "` + dstMetadata.GetName() + `"`)
+		return updateObjectWithRetries(step, config)
+	} else if step.action == "replace" {
+		src := *step.pair.src
+		dst := *step.pair.dst
+		dstMetadata, _ := getObjectMetadata(dst)
+		fmt.Fprintln(config.output(), "Replacing "+getObjectName(dst)+" with "+getObjectName(src)+" in "+dstMetadata.GetNamespace()+" namespace"+describeObjectSource(src))
+		printSchedulePreview(step, config)
 
-				if !execute {
-					break
-				}
+		if !apply {
+			return nil
+		}
 
-				err := clientset.BatchV1beta1().CronJobs(dstMetadata.GetNamespace()).Delete(dstMetadata.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+		//todo: delete current CronJob child Jobs
+		err := deleteObject(dst, config)
 
-				if err != nil {
-					panic(err)
-				}
+		if err != nil {
+			return err
+		}
+
+		if !config.dryRun {
+			err = waitForObjectDeletion(dst, config)
 
-				waitForObjectDeletion(dst, clientset)
-			default:
-				_ = dstType
+			if err != nil {
+				return err
 			}
-		} else if step.action == "update" {
-			src := *step.pair.src
-			dst := *step.pair.dst
-			srcMetadata, _ := getObjectMetadata(src)
-			dstMetadata, _ := getObjectMetadata(dst)
-			propagationPolicy := metav1.DeletePropagationForeground
-			//todo: use object metadata instead of type switch
-			switch srcType := src.(type) {
-			case *batchv1.Job:
-				dstGVK := getObjectGroupVersionKind(dst)
+		}
 
-				if dstGVK.Kind == "Job" {
-					fmt.Println(`Replacing Job "` + dstMetadata.GetName() + `" with Job "` + srcMetadata.GetName() + `" in ` + dstMetadata.GetNamespace() + ` namespace`)
+		err = createObject(getAppliedObject(src), config)
 
-					if !execute {
-						break
-					}
+		//a dry run delete leaves the object in place, so a replacement with the same name already exists
+		if config.dryRun && errors.IsAlreadyExists(err) && isSameObject(src, dst) {
+			return nil
+		}
 
-					err := clientset.BatchV1().Jobs(dstMetadata.GetNamespace()).Delete(dstMetadata.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+		if err != nil {
+			return err
+		}
 
-					if err != nil {
-						panic(err)
-					}
+		return waitForCreatedJob(src, config)
+	}
 
-					waitForObjectDeletion(dst, clientset)
+	return nil
+}
 
-					_, err = clientset.BatchV1().Jobs(srcMetadata.GetNamespace()).Create(src.(*batchv1.Job))
+func getStepObjectKeys(step Step) []string {
+	var keys []string
 
-					if err != nil {
-						panic(err)
-					}
-				} else if dstGVK.Kind == "CronJob" {
-					fmt.Println(`Replacing CronJob "` + dstMetadata.GetName() + `" with Job "` + srcMetadata.GetName() + `" in ` + dstMetadata.GetNamespace() + ` namespace`)
+	for _, o := range []*runtime.Object{step.pair.src, step.pair.dst} {
+		if o == nil {
+			continue
+		}
 
-					if !execute {
-						break
-					}
+		metadata, _ := getObjectMetadata(*o)
+		keys = append(keys, getObjectGroupVersionKind(*o).Kind+"/"+metadata.GetNamespace()+"/"+metadata.GetName())
+	}
 
-					//todo: delete current CronJob child Jobs
-					err := clientset.BatchV1beta1().CronJobs(dstMetadata.GetNamespace()).Delete(dstMetadata.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
-					if err != nil {
-						panic(err)
-					}
+	return keys
+}
 
-					waitForObjectDeletion(dst, clientset)
+func describeStep(step Step) string {
+	keys := getStepObjectKeys(step)
+	description := step.action + " " + strings.Join(keys, " -> ")
 
-					_, err = clientset.BatchV1().Jobs(srcMetadata.GetNamespace()).Create(src.(*batchv1.Job))
+	if step.pair.src != nil {
+		description += describeObjectSource(*step.pair.src)
+	}
 
-					if err != nil {
-						panic(err)
-					}
-				}
-			case *batchv1beta1.CronJob:
-				dstGVK := getObjectGroupVersionKind(dst)
+	return description
+}
+
+//steps are independent unless they touch the same object, so in continue-on-error mode
+//only steps sharing an object with a failed step are skipped
+func executePlan(plan []Step, config PlanConfig) []StepResult {
+	results := make([]StepResult, 0, len(plan))
+	failedKeys := make(map[string]bool)
+	failed := false
+	rolledBack := false
+
+	snapshots := make([]Snapshot, 0, len(plan))
 
-				if dstGVK.Kind == "Job" {
-					fmt.Println(`Replacing Job "` + dstMetadata.GetName() + `" with CronJob "` + srcMetadata.GetName() + `" in ` + dstMetadata.GetNamespace() + ` namespace`)
+	for _, step := range plan {
+		keys := getStepObjectKeys(step)
+		//a dry run changes nothing, so every step is checked regardless of earlier failures
+		skip := failed && !config.dryRun && (!config.continueOnError || config.rollback)
 
-					if !execute {
-						break
-					}
+		for _, key := range keys {
+			if failedKeys[key] {
+				skip = true
+			}
+		}
 
-					err := clientset.BatchV1().Jobs(dstMetadata.GetNamespace()).Delete(dstMetadata.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagationPolicy})
+		if skip {
+			results = append(results, StepResult{step: step, status: "skipped"})
+			continue
+		}
 
-					if err != nil {
-						panic(err)
-					}
+		if config.execute && !config.dryRun {
+			snapshot := takeSnapshot(step, config)
+			snapshot.result = len(results)
+			snapshots = append(snapshots, snapshot)
+		}
 
-					waitForObjectDeletion(dst, clientset)
+		err := executeStep(step, config)
 
-					_, err = clientset.BatchV1beta1().CronJobs(srcMetadata.GetNamespace()).Create(src.(*batchv1beta1.CronJob))
+		if err != nil {
+			fmt.Fprintln(config.output(), "Failed to "+describeStep(step)+": "+err.Error())
+			failed = true
 
-					if err != nil {
-						panic(err)
-					}
-				} else if dstGVK.Kind == "CronJob" {
-					fmt.Println(`Replacing CronJob "` + dstMetadata.GetName() + `" with CronJob "` + srcMetadata.GetName() + `" in ` + dstMetadata.GetNamespace() + ` namespace`)
+			for _, key := range keys {
+				failedKeys[key] = true
+			}
 
-					if !execute {
-						break
-					}
-					_, err := clientset.BatchV1beta1().CronJobs(srcMetadata.GetNamespace()).Update(src.(*batchv1beta1.CronJob))
+			results = append(results, StepResult{step: step, status: "failed", err: err})
 
-					if err != nil {
-						panic(err)
-					}
-				}
-			default:
-				_ = srcType
+			if config.rollback && config.execute {
+				snapshots = rollbackSnapshots(snapshots, results, config)
+				rolledBack = true
 			}
+
+			continue
+		}
+
+		results = append(results, StepResult{step: step, status: "succeeded"})
+	}
+
+	//after a rollback only the steps that could not be restored are left for undo
+	if len(snapshots) > 0 && config.snapshotFile != "" {
+		err := saveSnapshots(config.snapshotFile, snapshots)
+
+		if err != nil {
+			fmt.Fprintln(config.output(), "Failed to save snapshots: "+err.Error())
+		}
+	} else if rolledBack && config.snapshotFile != "" {
+		if err := os.Remove(config.snapshotFile); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(config.output(), "Failed to remove snapshots: "+err.Error())
 		}
 	}
 
 	if len(plan) == 0 {
-		fmt.Println("Nothing to do")
+		fmt.Fprintln(config.output(), "Nothing to do")
+	} else if config.execute || config.dryRun {
+		printResults(results, config.output())
 	} else {
-		fmt.Println("Finished")
+		fmt.Fprintln(config.output(), "Finished")
 	}
+
+	return results
+}
+
+func printResults(results []StepResult, out io.Writer) {
+	counts := make(map[string]int)
+
+	fmt.Fprintf(out, "\nResults:\n")
+
+	for _, result := range results {
+		counts[result.status]++
+		line := fmt.Sprintf("%-10s %s", result.status, describeStep(result.step))
+
+		if result.err != nil {
+			line += ": " + result.err.Error()
+		}
+
+		fmt.Fprintln(out, line)
+	}
+
+	fmt.Fprintf(out, "\nFinished: %d succeeded, %d failed, %d skipped", counts["succeeded"], counts["failed"], counts["skipped"])
+
+	if counts["rolled back"] > 0 {
+		fmt.Fprintf(out, ", %d rolled back", counts["rolled back"])
+	}
+
+	fmt.Fprintln(out)
+}
+
+func hasFailedSteps(results []StepResult) bool {
+	for _, result := range results {
+		if result.status == "failed" {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+//rules with actions are checked against planned steps, other rules against every local object
+type Policy struct {
+	Rules   []PolicyRule   `json:"rules"`
+	Waivers []PolicyWaiver `json:"waivers,omitempty"`
+}
+
+type PolicyRule struct {
+	Name       string            `json:"name"`
+	Message    string            `json:"message,omitempty"`
+	Match      PolicyMatch       `json:"match,omitempty"`
+	Conditions []PolicyCondition `json:"conditions,omitempty"`
+}
+
+type PolicyMatch struct {
+	Kinds      []string          `json:"kinds,omitempty"`
+	Namespaces []string          `json:"namespaces,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Actions    []string          `json:"actions,omitempty"`
+}
+
+type PolicyCondition struct {
+	Field    string      `json:"field"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+type PolicyWaiver struct {
+	Rule      string `json:"rule"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Reason    string `json:"reason"`
+	Expires   string `json:"expires,omitempty"`
+}
+
+type PolicyViolation struct {
+	rule    PolicyRule
+	object  runtime.Object
+	action  string
+	message string
+	waiver  *PolicyWaiver
+}
+
+var policyOperators = map[string]bool{
+	"exists": true, "notExists": true, "equals": true, "notEquals": true,
+	"in": true, "notIn": true, "matches": true, "notMatches": true,
+}
+
+//podSpec and jobSpec are shortcuts to the same fields in Jobs and CronJobs
+var policyFieldAliases = map[string]map[string]string{
+	"Job":     {"jobSpec": "spec", "podSpec": "spec.template.spec"},
+	"CronJob": {"jobSpec": "spec.jobTemplate.spec", "podSpec": "spec.jobTemplate.spec.template.spec"},
+}
+
+func readPolicy(path string) (Policy, error) {
+	var policy Policy
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return policy, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, &policy); err != nil {
+		return policy, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for _, rule := range policy.Rules {
+		if rule.Name == "" {
+			return policy, fmt.Errorf("%s: rule without a name", path)
+		}
+
+		for _, condition := range rule.Conditions {
+			if !policyOperators[condition.Operator] {
+				return policy, fmt.Errorf("%s: rule %q: unknown operator %q", path, rule.Name, condition.Operator)
+			}
+
+			if condition.Operator == "matches" || condition.Operator == "notMatches" {
+				if _, err := regexp.Compile(fmt.Sprint(condition.Value)); err != nil {
+					return policy, fmt.Errorf("%s: rule %q: %s", path, rule.Name, err.Error())
+				}
+			}
+		}
+	}
+
+	for _, waiver := range policy.Waivers {
+		if waiver.Rule == "" || waiver.Reason == "" {
+			return policy, fmt.Errorf("%s: waivers need a rule and a reason", path)
+		}
+
+		if _, err := time.Parse("2006-01-02", waiver.Expires); waiver.Expires != "" && err != nil {
+			return policy, fmt.Errorf("%s: waiver for %q: invalid expiry date %q", path, waiver.Rule, waiver.Expires)
+		}
+	}
+
+	return policy, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (match PolicyMatch) matches(object runtime.Object, action string) bool {
+	metadata, labels := getObjectMetadata(object)
+
+	if len(match.Kinds) > 0 && !containsString(match.Kinds, getObjectGroupVersionKind(object).Kind) {
+		return false
+	}
+
+	if len(match.Namespaces) > 0 && !containsString(match.Namespaces, metadata.GetNamespace()) {
+		return false
+	}
+
+	for k, v := range match.Labels {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return len(match.Actions) == 0 || containsString(match.Actions, action)
+}
+
+func splitPolicyField(field string) []string {
+	var parts []string
+
+	for _, part := range strings.Split(field, ".") {
+		for {
+			i := strings.Index(part, "[")
+
+			if i < 0 {
+				break
+			}
+
+			if i > 0 {
+				parts = append(parts, part[:i])
+			}
+
+			j := strings.Index(part, "]")
+
+			if j < i {
+				break
+			}
+
+			parts = append(parts, part[i:j+1])
+			part = part[j+1:]
+		}
+
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+//returns every value at a path such as podSpec.containers[*].image
+func resolvePolicyField(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+
+	part := parts[0]
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if field, ok := v[part]; ok && field != nil {
+			return resolvePolicyField(field, parts[1:])
+		}
+	case []interface{}:
+		if part == "[*]" {
+			var values []interface{}
+
+			for _, item := range v {
+				values = append(values, resolvePolicyField(item, parts[1:])...)
+			}
+
+			return values
+		}
+
+		if i, err := strconv.Atoi(strings.Trim(part, "[]")); err == nil && i >= 0 && i < len(v) {
+			return resolvePolicyField(v[i], parts[1:])
+		}
+	}
+
+	return nil
+}
+
+func formatPolicyValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func checkPolicyValue(value interface{}, condition PolicyCondition) bool {
+	actual := formatPolicyValue(value)
+
+	switch strings.TrimPrefix(strings.ToLower(condition.Operator), "not") {
+	case "equals":
+		return actual == formatPolicyValue(condition.Value)
+	case "in":
+		values, _ := condition.Value.([]interface{})
+
+		for _, v := range values {
+			if actual == formatPolicyValue(v) {
+				return true
+			}
+		}
+
+		return false
+	case "matches":
+		return regexp.MustCompile(fmt.Sprint(condition.Value)).MatchString(actual)
+	}
+
+	return false
+}
+
+//negated operators hold when no value matches, the others when every value matches,
+//so a missing field fails equals but passes notEquals, and a wildcard without values passes both
+func (condition PolicyCondition) holds(document interface{}, kind string) (bool, []interface{}) {
+	field := condition.Field
+
+	for alias, path := range policyFieldAliases[kind] {
+		if field == alias || strings.HasPrefix(field, alias+".") || strings.HasPrefix(field, alias+"[") {
+			field = path + strings.TrimPrefix(field, alias)
+		}
+	}
+
+	values := resolvePolicyField(document, splitPolicyField(field))
+
+	switch condition.Operator {
+	case "exists":
+		return len(values) > 0, values
+	case "notExists":
+		return len(values) == 0, values
+	}
+
+	negated := strings.HasPrefix(condition.Operator, "not")
+
+	if len(values) == 0 {
+		return negated || strings.Contains(field, "[*]"), values
+	}
+
+	for _, value := range values {
+		if checkPolicyValue(value, condition) == negated {
+			return false, values
+		}
+	}
+
+	return true, values
+}
+
+func (rule PolicyRule) check(object runtime.Object) []string {
+	b, err := getObjectJSON(removeObjectSource(object))
+
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var document interface{}
+	json.Unmarshal(b, &document)
+	kind := getObjectGroupVersionKind(object).Kind
+
+	//a rule without conditions forbids everything it matches
+	if len(rule.Conditions) == 0 {
+		return []string{rule.Message}
+	}
+
+	var messages []string
+
+	for _, condition := range rule.Conditions {
+		if ok, values := condition.holds(document, kind); !ok {
+			found := make([]string, 0, len(values))
+
+			for _, value := range values {
+				found = append(found, formatPolicyValue(value))
+			}
+
+			message := fmt.Sprintf("%s %s %s", condition.Field, condition.Operator, formatPolicyValue(condition.Value))
+
+			if condition.Value == nil {
+				message = condition.Field + " " + condition.Operator
+			}
+
+			if len(found) > 0 {
+				message += ", found " + strings.Join(found, ", ")
+			}
+
+			if rule.Message != "" {
+				message = rule.Message + " (" + message + ")"
+			}
+
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+func (policy Policy) findWaiver(rule PolicyRule, object runtime.Object, now time.Time) *PolicyWaiver {
+	metadata, _ := getObjectMetadata(object)
+
+	for i, waiver := range policy.Waivers {
+		if waiver.Rule != rule.Name ||
+			(waiver.Kind != "" && waiver.Kind != getObjectGroupVersionKind(object).Kind) ||
+			(waiver.Namespace != "" && waiver.Namespace != metadata.GetNamespace()) ||
+			(waiver.Name != "" && waiver.Name != metadata.GetName()) {
+			continue
+		}
+
+		//waivers are valid until the end of their expiry day
+		if expires, err := time.Parse("2006-01-02", waiver.Expires); waiver.Expires != "" && err == nil && !now.Before(expires.AddDate(0, 0, 1)) {
+			continue
+		}
+
+		return &policy.Waivers[i]
+	}
+
+	return nil
+}
+
+func evaluatePolicy(policy Policy, objects []runtime.Object, plan []Step, now time.Time) []PolicyViolation {
+	var violations []PolicyViolation
+
+	add := func(rule PolicyRule, object runtime.Object, action string) {
+		for _, message := range rule.check(object) {
+			violations = append(violations, PolicyViolation{rule: rule, object: object, action: action, message: message, waiver: policy.findWaiver(rule, object, now)})
+		}
+	}
+
+	for _, rule := range policy.Rules {
+		if len(rule.Match.Actions) == 0 {
+			for _, o := range objects {
+				if rule.Match.matches(o, "") {
+					add(rule, o, "")
+				}
+			}
+
+			continue
+		}
+
+		//deletions are checked against the cluster object, other steps against the local one
+		for _, step := range plan {
+			object := step.pair.src
+
+			if step.action == "delete" {
+				object = step.pair.dst
+			}
+
+			if object != nil && rule.Match.matches(*object, step.action) {
+				add(rule, *object, step.action)
+			}
+		}
+	}
+
+	return violations
+}
+
+//prints the violations and returns whether any of them is not waived
+func reportPolicyViolations(violations []PolicyViolation, out io.Writer) bool {
+	blocked := false
+
+	for _, violation := range violations {
+		target := getObjectName(violation.object) + describeObjectSource(violation.object)
+
+		if violation.action != "" {
+			target = violation.action + " " + target
+		}
+
+		message := ""
+
+		if violation.message != "" {
+			message = ": " + violation.message
+		}
+
+		if violation.waiver != nil {
+			fmt.Fprintf(out, "Waived policy %s for %s%s, %s\n", violation.rule.Name, target, message, violation.waiver.Reason)
+		} else {
+			fmt.Fprintf(out, "Policy %s violated by %s%s\n", violation.rule.Name, target, message)
+			blocked = true
+		}
+	}
+
+	if len(violations) > 0 {
+		fmt.Fprintln(out)
+	}
+
+	return blocked
+}
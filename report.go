@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+var reportModes = map[string]string{"preview": "Preview", "execute": "Execution", "server-dry-run": "Server-side dry run"}
+
+func formatReportObject(kind string, namespace string, name string) string {
+	return fmt.Sprintf("%s `%s/%s`", kind, namespace, name)
+}
+
+//removes fields serialized as null, such as empty timestamps
+func removeNullFields(document interface{}) {
+	switch v := document.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+			} else {
+				removeNullFields(value)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			removeNullFields(item)
+		}
+	}
+}
+
+//returns the lines of the object as YAML, prefixed for a diff block
+func getObjectDiffLines(object runtime.Object, prefix string) []string {
+	document, _ := getComparableDocument(object)
+	removeNullFields(document)
+	b, err := yaml.Marshal(document)
+
+	if err != nil {
+		return []string{prefix + " " + err.Error()}
+	}
+
+	var lines []string
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		lines = append(lines, prefix+" "+line)
+	}
+
+	return lines
+}
+
+func getStepDiffLines(step Step, output StepOutput) []string {
+	if step.action == "create" {
+		return getObjectDiffLines(*step.pair.src, "+")
+	} else if step.action == "delete" {
+		return getObjectDiffLines(*step.pair.dst, "-")
+	}
+
+	var lines []string
+
+	for _, change := range output.Changes {
+		lines = append(lines, "  "+change.Field+":")
+
+		if change.Old != nil {
+			lines = append(lines, "-   "+formatPolicyValue(change.Old))
+		}
+
+		if change.New != nil {
+			lines = append(lines, "+   "+formatPolicyValue(change.New))
+		}
+	}
+
+	return lines
+}
+
+//deletions and replacements remove cluster objects, and replaced Jobs lose their pods
+func getDestructiveWarning(output StepOutput) string {
+	if output.Action == "delete" {
+		return "Deleting " + formatReportObject(output.Kind, output.Namespace, output.Name) + " removes it from the cluster"
+	} else if output.Action == "replace" {
+		replaced := formatReportObject(output.Replaces.Kind, output.Namespace, output.Replaces.Name)
+		return "Replacing " + replaced + " deletes it, with its running Jobs and pods, before creating " + formatReportObject(output.Kind, output.Namespace, output.Name)
+	}
+
+	return ""
+}
+
+func renderMarkdownReport(results []StepResult, config PlanConfig, commit string) string {
+	output := getPlanOutput(results, config, commit)
+	counts := make(map[string]int)
+	var b strings.Builder
+
+	for _, step := range output.Steps {
+		counts[step.Action]++
+	}
+
+	b.WriteString("## kubechange plan\n\n")
+	b.WriteString(reportModes[output.Mode])
+
+	if commit != "" {
+		fmt.Fprintf(&b, " of commit `%s`", commit)
+	}
+
+	if len(output.Steps) == 0 {
+		b.WriteString(": nothing to do.\n")
+		return b.String()
+	}
+
+	b.WriteString(".\n\n")
+	b.WriteString("| Creates | Updates | Deletes | Replacements |\n")
+	b.WriteString("| ---: | ---: | ---: | ---: |\n")
+	fmt.Fprintf(&b, "| %d | %d | %d | %d |\n", counts["create"], counts["update"], counts["delete"], counts["replace"])
+
+	var warnings []string
+
+	for _, step := range output.Steps {
+		if warning := getDestructiveWarning(step); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	if len(warnings) > 0 {
+		b.WriteString("\n> :warning: **Destructive steps**\n>\n")
+
+		for _, warning := range warnings {
+			b.WriteString("> - " + warning + "\n")
+		}
+	}
+
+	b.WriteString("\n### Steps\n")
+
+	for i, step := range output.Steps {
+		summary := step.Action + " " + formatReportObject(step.Kind, step.Namespace, step.Name)
+
+		if step.Source != "" {
+			summary += " from `" + step.Source + "`"
+		}
+
+		if step.Status != "planned" {
+			summary += ", " + step.Status
+		}
+
+		fmt.Fprintf(&b, "\n<details>\n<summary>%s</summary>\n\n", summary)
+
+		if step.Error != "" {
+			fmt.Fprintf(&b, "Error: `%s`\n\n", step.Error)
+		}
+
+		b.WriteString("```diff\n")
+
+		for _, line := range getStepDiffLines(results[i].step, step) {
+			b.WriteString(line + "\n")
+		}
+
+		b.WriteString("```\n\n</details>\n")
+	}
+
+	return b.String()
+}
+
+func writeMarkdownReport(path string, results []StepResult, config PlanConfig, commit string) error {
+	return ioutil.WriteFile(path, []byte(renderMarkdownReport(results, config, commit)), 0644)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type RetryPolicy struct {
+	attempts int
+	deadline time.Duration
+	out      io.Writer
+}
+
+func (policy RetryPolicy) output() io.Writer {
+	return getOutputWriter(policy.out)
+}
+
+var retryBackoff = wait.Backoff{Duration: 500 * time.Millisecond, Factor: 2, Jitter: 0.5, Steps: 10, Cap: 30 * time.Second}
+
+func isRetriableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsTooManyRequests(err) ||
+		errors.IsServiceUnavailable(err) || errors.IsInternalError(err) || errors.IsUnexpectedServerError(err) {
+		return true
+	}
+
+	if status, ok := err.(errors.APIStatus); ok {
+		return status.Status().Code >= 500
+	}
+
+	if utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err) || strings.Contains(err.Error(), "connection refused") {
+		return true
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+//calls f until it succeeds, fails with an error that is not transient, or the policy runs out of attempts or time
+func (policy RetryPolicy) do(f func() error) error {
+	backoff := retryBackoff
+	started := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+
+		if !isRetriableError(err) || attempt >= policy.attempts {
+			return err
+		}
+
+		delay := backoff.Step()
+
+		if seconds, ok := errors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+
+		if policy.deadline > 0 && time.Since(started)+delay > policy.deadline {
+			return err
+		}
+
+		fmt.Fprintf(policy.output(), "Retrying in %s after error: %s\n", delay.Round(time.Millisecond), err.Error())
+		time.Sleep(delay)
+	}
+}
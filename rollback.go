@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+//created is the object a step writes to the cluster, previous is the live object it replaces
+type Snapshot struct {
+	action   string
+	created  runtime.Object
+	previous runtime.Object
+	result   int
+}
+
+type snapshotRecord struct {
+	Action   string          `json:"action"`
+	Created  json.RawMessage `json:"created,omitempty"`
+	Previous json.RawMessage `json:"previous,omitempty"`
+}
+
+var snapshotCodec = scheme.Codecs.LegacyCodec(batchv1.SchemeGroupVersion, batchv1beta1.SchemeGroupVersion)
+
+func takeSnapshot(step Step, config PlanConfig) Snapshot {
+	snapshot := Snapshot{action: step.action}
+
+	if step.pair.dst != nil {
+		snapshot.previous = (*step.pair.dst).DeepCopyObject()
+
+		if live, err := getObject(snapshot.previous, config); err == nil {
+			snapshot.previous = live.DeepCopyObject()
+		}
+	}
+
+	if step.pair.src != nil {
+		snapshot.created = (*step.pair.src).DeepCopyObject()
+
+		//objects that already existed and are not being replaced were not created by this step
+		if snapshot.previous == nil || !isSameObject(snapshot.created, snapshot.previous) {
+			if _, err := getObject(snapshot.created, config); err == nil {
+				snapshot.created = nil
+			}
+		}
+	}
+
+	return snapshot
+}
+
+func stripServerFields(object runtime.Object) runtime.Object {
+	object = object.DeepCopyObject()
+	metadata, _ := getObjectMetadata(object)
+	metadata.SetResourceVersion("")
+	metadata.SetUID("")
+	metadata.SetSelfLink("")
+	metadata.SetGeneration(0)
+	metadata.SetCreationTimestamp(metav1.Time{})
+	metadata.SetDeletionTimestamp(nil)
+
+	switch t := object.(type) {
+	case *batchv1.Job:
+		t.Status = batchv1.JobStatus{}
+
+		//generated selectors are rejected on create unless manualSelector is set
+		if t.Spec.ManualSelector == nil || !*t.Spec.ManualSelector {
+			t.Spec.Selector = nil
+			delete(t.Spec.Template.Labels, "controller-uid")
+			delete(t.Spec.Template.Labels, "job-name")
+		}
+	case *batchv1beta1.CronJob:
+		t.Status = batchv1beta1.CronJobStatus{}
+	}
+
+	return object
+}
+
+func isSameObject(a runtime.Object, b runtime.Object) bool {
+	aMetadata, _ := getObjectMetadata(a)
+	bMetadata, _ := getObjectMetadata(b)
+
+	return getObjectGroupVersionKind(a).Kind == getObjectGroupVersionKind(b).Kind &&
+		aMetadata.GetNamespace() == bMetadata.GetNamespace() &&
+		aMetadata.GetName() == bMetadata.GetName()
+}
+
+func restoreSnapshot(snapshot Snapshot, config PlanConfig) error {
+	//objects updated in place are updated back, everything else is deleted and recreated
+	if snapshot.action == "update" && snapshot.created != nil && snapshot.previous != nil && isSameObject(snapshot.created, snapshot.previous) {
+		fmt.Fprintln(config.output(), "Restoring "+getObjectName(snapshot.previous))
+
+		if !config.execute {
+			return nil
+		}
+
+		live, err := getObject(snapshot.previous, config)
+
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		if err == nil {
+			liveMetadata, _ := getObjectMetadata(live)
+			previous := snapshot.previous.DeepCopyObject()
+			previousMetadata, _ := getObjectMetadata(previous)
+			previousMetadata.SetResourceVersion(liveMetadata.GetResourceVersion())
+
+			return updateObject(previous, config)
+		}
+	} else if snapshot.created != nil {
+		fmt.Fprintln(config.output(), "Deleting "+getObjectName(snapshot.created))
+
+		if config.execute {
+			err := deleteObject(snapshot.created, config)
+
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+
+			err = waitForObjectDeletion(snapshot.created, config)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if snapshot.previous == nil {
+		return nil
+	}
+
+	fmt.Fprintln(config.output(), "Recreating "+getObjectName(snapshot.previous))
+
+	if !config.execute {
+		return nil
+	}
+
+	err := createObject(stripServerFields(snapshot.previous), config)
+
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+//restores snapshots in reverse order and marks the steps that were undone
+//returns the snapshots that could not be restored, in their original order
+func rollbackSnapshots(snapshots []Snapshot, results []StepResult, config PlanConfig) []Snapshot {
+	fmt.Fprintln(config.output(), "Rolling back applied steps")
+	var remaining []Snapshot
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		err := restoreSnapshot(snapshots[i], config)
+
+		if err != nil {
+			fmt.Fprintln(config.output(), "Failed to roll back "+snapshots[i].action+" step: "+err.Error())
+			remaining = append([]Snapshot{snapshots[i]}, remaining...)
+			continue
+		}
+
+		if index := snapshots[i].result; index < len(results) && results[index].status == "succeeded" {
+			results[index].status = "rolled back"
+		}
+	}
+
+	return remaining
+}
+
+func saveSnapshots(path string, snapshots []Snapshot) error {
+	records := make([]snapshotRecord, 0, len(snapshots))
+
+	for _, snapshot := range snapshots {
+		record := snapshotRecord{Action: snapshot.action}
+
+		for _, o := range []struct {
+			object runtime.Object
+			field  *json.RawMessage
+		}{{snapshot.created, &record.Created}, {snapshot.previous, &record.Previous}} {
+			if o.object == nil {
+				continue
+			}
+
+			b, err := runtime.Encode(snapshotCodec, o.object)
+
+			if err != nil {
+				return err
+			}
+
+			*o.field = json.RawMessage(b)
+		}
+
+		records = append(records, record)
+	}
+
+	b, err := json.MarshalIndent(records, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func loadSnapshots(path string) ([]Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var records []snapshotRecord
+	err = json.Unmarshal(b, &records)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(records))
+
+	for _, record := range records {
+		snapshot := Snapshot{action: record.Action}
+
+		if len(record.Created) > 0 {
+			snapshot.created, _, err = scheme.Codecs.UniversalDeserializer().Decode(record.Created, nil, nil)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(record.Previous) > 0 {
+			snapshot.previous, _, err = scheme.Codecs.UniversalDeserializer().Decode(record.Previous, nil, nil)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+func undoLastRun(path string, config PlanConfig) error {
+	snapshots, err := loadSnapshots(path)
+
+	if err != nil {
+		return err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		err := restoreSnapshot(snapshots[i], config)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(snapshots) == 0 {
+		fmt.Fprintln(config.output(), "Nothing to do")
+	} else {
+		fmt.Fprintln(config.output(), "Finished")
+	}
+
+	return nil
+}
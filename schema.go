@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+//types are object, array, string, integer, number, boolean, int-or-string, quantity or empty for any value
+type SchemaNode struct {
+	typ        string
+	properties map[string]*SchemaNode
+	additional *SchemaNode
+	items      *SchemaNode
+	required   []string
+}
+
+//schemas by apiVersion and kind, built from the bundled Go types unless loaded from a cluster swagger file
+type SchemaSet struct {
+	bundled bool
+	roots   map[string]*SchemaNode
+}
+
+type SchemaError struct {
+	path    []string
+	message string
+}
+
+type swaggerDefinition struct {
+	Type                 string                       `json:"type"`
+	Format               string                       `json:"format"`
+	Ref                  string                       `json:"$ref"`
+	Properties           map[string]swaggerDefinition `json:"properties"`
+	AdditionalProperties *swaggerDefinition           `json:"additionalProperties"`
+	Items                *swaggerDefinition           `json:"items"`
+	Required             []string                     `json:"required"`
+	GroupVersionKinds    []schema.GroupVersionKind    `json:"x-kubernetes-group-version-kind"`
+}
+
+var (
+	timeType         = reflect.TypeOf(metav1.Time{})
+	microTimeType    = reflect.TypeOf(metav1.MicroTime{})
+	quantityType     = reflect.TypeOf(resource.Quantity{})
+	intOrStringType  = reflect.TypeOf(intstr.IntOrString{})
+	rawExtensionType = reflect.TypeOf(runtime.RawExtension{})
+	unmarshalerType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+var yamlKeyPattern = regexp.MustCompile(`^["']?([^"':]+)["']?\s*:(\s|$)`)
+
+func newBundledSchemaSet() *SchemaSet {
+	return &SchemaSet{bundled: true, roots: make(map[string]*SchemaNode)}
+}
+
+func (schemas *SchemaSet) lookup(apiVersion string, kind string) *SchemaNode {
+	key := apiVersion + "/" + kind
+
+	if node, ok := schemas.roots[key]; ok || !schemas.bundled {
+		return node
+	}
+
+	object, err := scheme.Scheme.New(schema.FromAPIVersionAndKind(apiVersion, kind))
+
+	if err != nil {
+		schemas.roots[key] = nil
+		return nil
+	}
+
+	node := getTypeSchema(reflect.TypeOf(object).Elem(), make(map[reflect.Type]*SchemaNode))
+	schemas.roots[key] = node
+	return node
+}
+
+//fields without omitempty are required, following the convention of the Kubernetes API types
+func getTypeSchema(t reflect.Type, cache map[reflect.Type]*SchemaNode) *SchemaNode {
+	switch t {
+	case timeType, microTimeType:
+		return &SchemaNode{typ: "string"}
+	case quantityType:
+		return &SchemaNode{typ: "quantity"}
+	case intOrStringType:
+		return &SchemaNode{typ: "int-or-string"}
+	case rawExtensionType:
+		return &SchemaNode{}
+	}
+
+	if node, ok := cache[t]; ok {
+		return node
+	}
+
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return &SchemaNode{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return getTypeSchema(t.Elem(), cache)
+	case reflect.String:
+		return &SchemaNode{typ: "string"}
+	case reflect.Bool:
+		return &SchemaNode{typ: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &SchemaNode{typ: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &SchemaNode{typ: "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &SchemaNode{typ: "string"}
+		}
+
+		return &SchemaNode{typ: "array", items: getTypeSchema(t.Elem(), cache)}
+	case reflect.Map:
+		return &SchemaNode{typ: "object", additional: getTypeSchema(t.Elem(), cache)}
+	case reflect.Struct:
+		node := &SchemaNode{typ: "object", properties: make(map[string]*SchemaNode)}
+		cache[t] = node
+		addStructProperties(node, t, cache)
+		return node
+	}
+
+	return &SchemaNode{}
+}
+
+func addStructProperties(node *SchemaNode, t reflect.Type, cache map[reflect.Type]*SchemaNode) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+
+		if field.PkgPath != "" || tag[0] == "-" {
+			continue
+		}
+
+		options := strings.Join(tag[1:], ",")
+
+		if strings.Contains(options, "inline") || (field.Anonymous && tag[0] == "") {
+			addStructProperties(node, field.Type, cache)
+			continue
+		}
+
+		name := tag[0]
+
+		if name == "" {
+			name = field.Name
+		}
+
+		node.properties[name] = getTypeSchema(field.Type, cache)
+
+		if !strings.Contains(options, "omitempty") {
+			node.required = append(node.required, name)
+		}
+	}
+}
+
+//loads the swagger document served by the API server at /openapi/v2
+func loadSchemaFile(path string) (*SchemaSet, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Definitions map[string]swaggerDefinition `json:"definitions"`
+	}
+
+	if err := json.Unmarshal(b, &document); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	schemas := &SchemaSet{roots: make(map[string]*SchemaNode)}
+	cache := make(map[string]*SchemaNode)
+
+	for name, definition := range document.Definitions {
+		for _, gvk := range definition.GroupVersionKinds {
+			apiVersion := gvk.GroupVersion().String()
+			schemas.roots[apiVersion+"/"+gvk.Kind] = getSwaggerSchema(swaggerDefinition{Ref: "#/definitions/" + name}, document.Definitions, cache)
+		}
+	}
+
+	return schemas, nil
+}
+
+func getSwaggerSchema(definition swaggerDefinition, definitions map[string]swaggerDefinition, cache map[string]*SchemaNode) *SchemaNode {
+	if definition.Ref != "" {
+		name := strings.TrimPrefix(definition.Ref, "#/definitions/")
+
+		if node, ok := cache[name]; ok {
+			return node
+		}
+
+		node := &SchemaNode{}
+		cache[name] = node
+
+		if strings.HasSuffix(name, ".Quantity") {
+			node.typ = "quantity"
+		} else if referenced, ok := definitions[name]; ok {
+			*node = *getSwaggerSchema(referenced, definitions, cache)
+		}
+
+		return node
+	}
+
+	if definition.Format == "int-or-string" {
+		return &SchemaNode{typ: "int-or-string"}
+	}
+
+	node := &SchemaNode{typ: definition.Type, required: definition.Required}
+
+	if definition.Items != nil {
+		node.items = getSwaggerSchema(*definition.Items, definitions, cache)
+	}
+
+	if definition.AdditionalProperties != nil {
+		node.additional = getSwaggerSchema(*definition.AdditionalProperties, definitions, cache)
+	}
+
+	if len(definition.Properties) > 0 {
+		node.properties = make(map[string]*SchemaNode)
+
+		for name, property := range definition.Properties {
+			node.properties[name] = getSwaggerSchema(property, definitions, cache)
+		}
+	}
+
+	//objects without a declared shape accept any fields
+	if node.typ == "object" && node.properties == nil && node.additional == nil {
+		node.typ = ""
+	}
+
+	return node
+}
+
+func getValueType(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+
+		return "number"
+	}
+
+	return "null"
+}
+
+func isValueOfType(value interface{}, typ string) bool {
+	valueType := getValueType(value)
+
+	switch typ {
+	case "", valueType:
+		return true
+	case "number":
+		return valueType == "integer"
+	case "int-or-string":
+		return valueType == "integer" || valueType == "string"
+	case "quantity":
+		return valueType == "integer" || valueType == "number" || valueType == "string"
+	}
+
+	return false
+}
+
+func (node *SchemaNode) validate(value interface{}, path []string, errors []SchemaError) []SchemaError {
+	if node == nil || value == nil {
+		return errors
+	}
+
+	if !isValueOfType(value, node.typ) {
+		return append(errors, SchemaError{path: path, message: fmt.Sprintf("expected %s, got %s", node.typ, getValueType(value))})
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldPath := append(append([]string{}, path...), key)
+
+			if property, ok := node.properties[key]; ok {
+				errors = property.validate(v[key], fieldPath, errors)
+			} else if node.additional != nil {
+				errors = node.additional.validate(v[key], fieldPath, errors)
+			} else if node.properties != nil {
+				errors = append(errors, SchemaError{path: fieldPath, message: "unknown field"})
+			}
+		}
+
+		for _, name := range node.required {
+			if _, ok := v[name]; !ok {
+				errors = append(errors, SchemaError{path: path, message: fmt.Sprintf("missing required field %q", name)})
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			errors = node.items.validate(item, append(append([]string{}, path...), fmt.Sprintf("[%d]", i)), errors)
+		}
+	}
+
+	return errors
+}
+
+func formatSchemaPath(path []string) string {
+	return strings.Replace(strings.Join(path, "."), ".[", "[", -1)
+}
+
+type yamlLine struct {
+	indent        int
+	contentIndent int
+	dash          bool
+	content       string
+}
+
+func parseYAMLLine(line string) (yamlLine, bool) {
+	content := strings.TrimLeft(line, " ")
+
+	if strings.TrimSpace(content) == "" || strings.HasPrefix(content, "#") {
+		return yamlLine{}, false
+	}
+
+	parsed := yamlLine{indent: len(line) - len(content)}
+
+	for strings.HasPrefix(content, "- ") || content == "-" {
+		parsed.dash = true
+		trimmed := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+		parsed.contentIndent += len(content) - len(trimmed)
+		content = trimmed
+	}
+
+	parsed.contentIndent += parsed.indent
+	parsed.content = content
+	return parsed, true
+}
+
+//finds the line of a field in a block style YAML document, falling back to the closest parent found
+func findYAMLPathLine(data []byte, path []string) int {
+	lines := strings.Split(string(data), "\n")
+	found := 0
+	start := 0
+	parentIndent := -1
+	itemScope := false
+
+	//an item spans the lines indented past its dash, and a key's block can start with a sequence at its own indent
+	inBlock := func(line yamlLine, i int) bool {
+		if itemScope {
+			return i == start || line.indent > parentIndent
+		}
+
+		return line.contentIndent > parentIndent || (line.dash && line.indent >= parentIndent)
+	}
+
+	for _, element := range path {
+		index := -1
+		fmt.Sscanf(element, "[%d]", &index)
+		childIndent := -1
+		match := -1
+
+		for i := start; i < len(lines) && match < 0; i++ {
+			line, ok := parseYAMLLine(lines[i])
+
+			if !ok {
+				continue
+			}
+
+			if !inBlock(line, i) {
+				break
+			}
+
+			if index >= 0 {
+				if !line.dash || (childIndent >= 0 && line.indent != childIndent) {
+					continue
+				}
+
+				childIndent = line.indent
+
+				if index == 0 {
+					match = i
+				}
+
+				index--
+			} else {
+				if childIndent < 0 {
+					childIndent = line.contentIndent
+				}
+
+				if m := yamlKeyPattern.FindStringSubmatch(line.content); line.contentIndent == childIndent && m != nil && m[1] == element {
+					match = i
+				}
+			}
+		}
+
+		if match < 0 {
+			return found
+		}
+
+		line, _ := parseYAMLLine(lines[match])
+		found = match
+		itemScope = strings.HasPrefix(element, "[")
+
+		//keys on the same line as the dash belong to the item
+		if itemScope {
+			start = match
+			parentIndent = line.indent
+		} else {
+			start = match + 1
+			parentIndent = line.contentIndent
+		}
+	}
+
+	return found
+}
+
+func validateDocumentSchema(document ManifestDocument, schemas *SchemaSet) []string {
+	data, err := yaml.YAMLToJSON(document.data)
+
+	if err != nil {
+		return nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+
+	var errors []SchemaError
+	errors = validateSchemaValue(value, nil, schemas, errors)
+	messages := make([]string, 0, len(errors))
+
+	for _, e := range errors {
+		line := document.line + findYAMLPathLine(document.data, e.path)
+		field := formatSchemaPath(e.path)
+
+		if field == "" {
+			field = "document"
+		}
+
+		messages = append(messages, fmt.Sprintf("%s:%d: %s: %s", document.path, line, field, e.message))
+	}
+
+	return messages
+}
+
+//lists are validated item by item, against the schema of each item's own kind
+func validateSchemaValue(value interface{}, path []string, schemas *SchemaSet, errors []SchemaError) []SchemaError {
+	object, ok := value.(map[string]interface{})
+
+	if !ok {
+		return errors
+	}
+
+	apiVersion, _ := object["apiVersion"].(string)
+	kind, _ := object["kind"].(string)
+
+	if items, ok := object["items"].([]interface{}); ok && strings.HasSuffix(kind, "List") {
+		for i, item := range items {
+			itemPath := append(append([]string{}, path...), "items", fmt.Sprintf("[%d]", i))
+
+			//items of typed lists such as JobList can omit their kind
+			if itemObject, ok := item.(map[string]interface{}); ok && itemObject["kind"] == nil && kind != "List" {
+				errors = schemas.lookup(apiVersion, strings.TrimSuffix(kind, "List")).validate(item, itemPath, errors)
+			} else {
+				errors = validateSchemaValue(item, itemPath, schemas, errors)
+			}
+		}
+
+		return errors
+	}
+
+	return schemas.lookup(apiVersion, kind).validate(value, path, errors)
+}
+
+//reports the errors of every file at once, so they can all be fixed before the next run
+func validateManifestSchemas(files []ManifestFile, schemas *SchemaSet) error {
+	var messages []string
+
+	for _, file := range files {
+		documents, err := splitManifestDocuments(file)
+
+		if err != nil {
+			return err
+		}
+
+		for _, document := range documents {
+			messages = append(messages, validateDocumentSchema(document, schemas)...)
+		}
+	}
+
+	if len(messages) > 0 {
+		return fmt.Errorf("schema validation failed:\n%s", strings.Join(messages, "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+//$${ escapes a literal ${, {{ .Values.x }} and ${x} both look up dotted paths in the values
+var variablePattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}|\{\{-?\s*\.Values\.([A-Za-z0-9_.-]+)\s*-?\}\}`)
+
+type StringList []string
+
+func (list *StringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *StringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func mergeValues(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+
+		if srcIsMap && dstIsMap {
+			mergeValues(dstMap, srcMap)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+func setValue(values map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := values[key].(map[string]interface{})
+
+		if !ok {
+			next = make(map[string]interface{})
+			values[key] = next
+		}
+
+		values = next
+	}
+
+	values[keys[len(keys)-1]] = value
+}
+
+//like helm, --set values that look like booleans or integers are typed so that chart conditions work
+func parseSetValue(value string) interface{} {
+	if b, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+		return b
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+
+	return value
+}
+
+//environment variables have the lowest precedence, then values files in order, then --set flags
+func loadValues(environ []string, valuesFiles []string, sets []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	for _, variable := range environ {
+		if i := strings.Index(variable, "="); i > 0 {
+			values[variable[:i]] = variable[i+1:]
+		}
+	}
+
+	for _, path := range valuesFiles {
+		b, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fileValues := make(map[string]interface{})
+
+		if err := yaml.Unmarshal(b, &fileValues); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		mergeValues(values, fileValues)
+	}
+
+	for _, set := range sets {
+		i := strings.Index(set, "=")
+
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --set %q, expected key=value", set)
+		}
+
+		setValue(values, set[:i], parseSetValue(set[i+1:]))
+	}
+
+	return values, nil
+}
+
+func lookupValue(values map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = values
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+//numbers in values files are decoded as floats, which would otherwise be printed in exponent form
+func formatValue(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
+
+//replaces variables in the file content, failing with every unresolved variable and its line
+func substituteVariables(file ManifestFile, values map[string]interface{}) (ManifestFile, error) {
+	var unresolved []string
+	lines := strings.SplitAfter(file.content, "\n")
+
+	for i, line := range lines {
+		lines[i] = variablePattern.ReplaceAllStringFunc(line, func(match string) string {
+			if match == "$${" {
+				return "${"
+			}
+
+			groups := variablePattern.FindStringSubmatch(match)
+			path := groups[1] + groups[2]
+			value, ok := lookupValue(values, path)
+
+			if ok {
+				switch value.(type) {
+				case map[string]interface{}, []interface{}:
+					ok = false
+				}
+			}
+
+			if !ok || value == nil {
+				unresolved = append(unresolved, fmt.Sprintf("%s at line %d", match, i+1))
+				return match
+			}
+
+			return formatValue(value)
+		})
+	}
+
+	if len(unresolved) > 0 {
+		return file, fmt.Errorf("%s: unresolved variables: %s", file.path, strings.Join(unresolved, ", "))
+	}
+
+	return ManifestFile{path: file.path, content: strings.Join(lines, "")}, nil
+}
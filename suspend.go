@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+//records spec.suspend as it was before kubechange suspended a CronJob
+const suspendedAnnotation = "kubechange/suspended-from"
+
+func getLabeledCronJobs(label string, namespace string, config PlanConfig) ([]*batchv1beta1.CronJob, error) {
+	objects, err := listObjects(namespace, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var cronJobs []*batchv1beta1.CronJob
+
+	for _, o := range filterObjectsByLabel(filterObjectsByNamespace(objects, namespace), label) {
+		if cronJob, ok := o.(*batchv1beta1.CronJob); ok {
+			cronJobs = append(cronJobs, cronJob)
+		}
+	}
+
+	return cronJobs, nil
+}
+
+func patchCronJobSuspend(cronJob *batchv1beta1.CronJob, suspend bool, annotation *string, config PlanConfig) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": cronJob.ResourceVersion,
+			"annotations":     map[string]*string{suspendedAnnotation: annotation},
+		},
+		"spec": map[string]interface{}{
+			"suspend": suspend,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return applyPatch(cronJob, types.MergePatchType, patch, config)
+}
+
+//suspends every CronJob matching the label, unless kubechange already suspended it
+func suspendCronJobs(label string, namespace string, config PlanConfig) error {
+	cronJobs, err := getLabeledCronJobs(label, namespace, config)
+
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var changed int
+
+	for _, cronJob := range cronJobs {
+		if _, ok := cronJob.Annotations[suspendedAnnotation]; ok {
+			continue
+		}
+
+		suspended := cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend
+		original := strconv.FormatBool(suspended)
+		changed++
+		fmt.Println("Suspending " + getObjectName(cronJob) + " in " + cronJob.Namespace + " namespace")
+
+		if !config.execute && !config.dryRun {
+			continue
+		}
+
+		err := patchCronJobSuspend(cronJob, true, &original, config)
+
+		if err != nil {
+			fmt.Println("Failed to suspend " + getObjectName(cronJob) + ": " + err.Error())
+			failed++
+		}
+	}
+
+	return reportSuspendResults(changed, failed)
+}
+
+//restores spec.suspend only on CronJobs that kubechange suspended
+func resumeCronJobs(label string, namespace string, config PlanConfig) error {
+	cronJobs, err := getLabeledCronJobs(label, namespace, config)
+
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var changed int
+
+	for _, cronJob := range cronJobs {
+		original, ok := cronJob.Annotations[suspendedAnnotation]
+
+		if !ok {
+			continue
+		}
+
+		suspended, _ := strconv.ParseBool(original)
+		changed++
+		fmt.Println("Resuming " + getObjectName(cronJob) + " in " + cronJob.Namespace + " namespace")
+
+		if !config.execute && !config.dryRun {
+			continue
+		}
+
+		err := patchCronJobSuspend(cronJob, suspended, nil, config)
+
+		if err != nil {
+			fmt.Println("Failed to resume " + getObjectName(cronJob) + ": " + err.Error())
+			failed++
+		}
+	}
+
+	return reportSuspendResults(changed, failed)
+}
+
+func reportSuspendResults(changed int, failed int) error {
+	if changed == 0 {
+		fmt.Println("Nothing to do")
+	} else if failed > 0 {
+		return fmt.Errorf("Failed to update %d of %d CronJobs", failed, changed)
+	} else {
+		fmt.Println("Finished")
+	}
+
+	return nil
+}